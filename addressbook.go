@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// addressBook maps lowercase names, e.g. of correspondents, to mail addresses, it is loaded once at startup, see loadAddressBook
+var addressBook map[string]string
+
+// loadAddressBook reads the address book of Email.AddressBook. The file is a yaml map of names to addresses,
+// a value may hold a comma separated list.
+func loadAddressBook() error {
+	addressBook = make(map[string]string)
+	path := Config.Email.AddressBook
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(resolveConfigPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("address book %s does not exist", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read address book %s: %v", path, err)
+	}
+
+	var entries map[string]string
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse address book %s: %v", path, err)
+	}
+	for name, address := range entries {
+		if _, err := parseRenderedAddresses([]string{address}); err != nil {
+			return fmt.Errorf("address book %s, entry %s: %v", path, name, err)
+		}
+		addressBook[strings.ToLower(strings.TrimSpace(name))] = address
+	}
+	log.Printf("loaded %d address(es) from address book %s", len(addressBook), path)
+	return nil
+}
+
+// lookupAddress returns the address of the name in the address book, e.g. `{{address .Correspondent.Name}}`.
+// Names are compared case insensitive, unknown names return an empty string.
+func lookupAddress(name string) string {
+	return addressBook[strings.ToLower(strings.TrimSpace(name))]
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// attachment policies of a rule, they decide which files of a document are attached
+const (
+	attachmentArchive  = "archive"
+	attachmentOriginal = "original"
+	attachmentBoth     = "both"
+)
+
+// attachmentExtensions maps the content types paperless accepts to their preferred filename extension.
+// Types not listed here fall back to the mime type table of the system.
+var attachmentExtensions = map[string]string{
+	"application/pdf": ".pdf",
+	"application/rtf": ".rtf",
+	"message/rfc822":  ".eml",
+
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/tiff": ".tiff",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/heic": ".heic",
+	"image/bmp":  ".bmp",
+
+	"text/plain": ".txt",
+	"text/csv":   ".csv",
+	"text/html":  ".html",
+
+	"application/msword":            ".doc",
+	"application/vnd.ms-excel":      ".xls",
+	"application/vnd.ms-powerpoint": ".ppt",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+}
+
+// newDocumentAttachment creates the mail attachment of the downloaded document. The extension of the
+// filename is replaced if it does not match the content type, e.g. a JPEG original named like the archived PDF.
+func newDocumentAttachment(doc *paperless.Document, data []byte, original bool) mailAttachment {
+	contentType := doc.ContentType(data, original)
+	return mailAttachment{
+		Filename:    attachmentFileName(path.Base(getFileName(doc)), contentType),
+		ContentType: contentType,
+		Data:        data,
+	}
+}
+
+// downloadAttachments downloads the files of the document the attachment policy asks for. A document
+// without archived version only has its original, so it is attached once.
+func downloadAttachments(ctx context.Context, client paperless.Client, doc *paperless.Document, policy string) ([]mailAttachment, error) {
+	originals := []bool{policy == attachmentOriginal}
+	if policy == attachmentBoth && doc.HasArchivedFile() {
+		originals = []bool{false, true}
+	}
+
+	var attachments []mailAttachment
+	for _, original := range originals {
+		data, err := client.DownloadDocumentBinary(ctx, *doc, original)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, newDocumentAttachment(doc, data, original))
+	}
+
+	// both files can be PDFs with the same name
+	if len(attachments) == 2 && strings.EqualFold(attachments[0].Filename, attachments[1].Filename) {
+		name := attachments[1].Filename
+		ext := path.Ext(name)
+		attachments[1].Filename = fmt.Sprintf("%s (original)%s", strings.TrimSuffix(name, ext), ext)
+	}
+	return attachments, nil
+}
+
+// attachmentFileName returns the filename with an extension matching the content type
+func attachmentFileName(filename, contentType string) string {
+	ext := path.Ext(filename)
+	if !isFileExtension(ext) {
+		// e.g. the dot of "Invoice No. 5" does not start an extension
+		ext = ""
+	}
+
+	extensions, _ := mime.ExtensionsByType(contentType)
+	preferred, ok := attachmentExtensions[contentType]
+	if ok {
+		extensions = append(extensions, preferred)
+	} else if len(extensions) > 0 {
+		preferred = extensions[0]
+	} else {
+		// unknown type, there is nothing to compare the extension with
+		return filename
+	}
+
+	for _, candidate := range extensions {
+		if strings.EqualFold(ext, candidate) {
+			return filename
+		}
+	}
+	return strings.TrimSuffix(filename, ext) + preferred
+}
+
+// isFileExtension returns true for short alphanumeric extensions like ".pdf"
+func isFileExtension(ext string) bool {
+	if len(ext) < 2 || len(ext) > 6 {
+		return false
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesMimeType returns true if the mime type matches the pattern, e.g. "image/png" or "image/*"
+func matchesMimeType(pattern, mimeType string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(mimeType))
+	return err == nil && ok
+}
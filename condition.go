@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// condition is a node of the boolean condition tree of a rule. Exactly one field must be set per node:
+// either one of the operators All, Any and Not, or one of the comparisons against the document.
+//
+//	Condition:
+//	  All:
+//	    - Any:
+//	        - Tag: Invoice
+//	        - Tag: Receipt
+//	    - Not:
+//	        Tag: Private
+//	    - MimeType: application/pdf
+//	    - CustomField:
+//	        Name: Amount
+//	        GreaterThan: 1000
+type condition struct {
+	All           []condition
+	Any           []condition
+	Not           *condition
+	Tag           string
+	Correspondent string
+	Type          string
+	StoragePath   string
+	Owner         string
+	// MimeType matches the type of the original file, wildcards like "image/*" are allowed
+	MimeType    string
+	CustomField *customFieldCondition
+}
+
+// documentData bundles a document with the entities it references in paperless
+type documentData struct {
+	Document      *paperless.Document
+	Tags          []paperless.Tag
+	Correspondent *paperless.Correspondent
+	DocumentType  *paperless.DocumentType
+	StoragePath   *paperless.StoragePath
+	Owner         *paperless.User
+	CustomFields  []customFieldValue
+}
+
+// newDocumentData resolves the tags, correspondent, type, storage path and owner of the document.
+// Referenced entities that can't be found are left empty.
+func newDocumentData(doc *paperless.Document, tags []paperless.Tag, correspondents []paperless.Correspondent, documentTypes []paperless.DocumentType, storagePaths []paperless.StoragePath, users []paperless.User, customFields []paperless.CustomField) (*documentData, error) {
+	d := &documentData{
+		Document:      doc,
+		Correspondent: paperless.CorrespondentByID(correspondents, doc.CorrespondentId),
+		DocumentType:  paperless.DocumentTypeByID(documentTypes, doc.DocumentTypeId),
+		StoragePath:   paperless.StoragePathByID(storagePaths, doc.StoragePath),
+		Owner:         paperless.UserByID(users, doc.OwnerId),
+		CustomFields:  newCustomFieldValues(doc.CustomFields, customFields),
+	}
+
+	for _, id := range doc.TagIDs {
+		tag := paperless.TagByID(tags, id)
+		if tag == nil {
+			return nil, fmt.Errorf("Tag %d is not available in tags list", id)
+		}
+		d.Tags = append(d.Tags, *tag)
+	}
+	return d, nil
+}
+
+// hasTagName returns true if the document holds a tag with the name
+func (d *documentData) hasTagName(name string) bool {
+	return paperless.TagByName(d.Tags, name) != nil
+}
+
+// validate checks that every node of the tree sets exactly one operator or comparison
+func (c condition) validate() error {
+	set := 0
+	for _, isSet := range []bool{
+		c.All != nil, c.Any != nil, c.Not != nil,
+		c.Tag != "", c.Correspondent != "", c.Type != "", c.StoragePath != "", c.Owner != "", c.MimeType != "", c.CustomField != nil,
+	} {
+		if isSet {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return fmt.Errorf("condition %s must set exactly one of `All`, `Any`, `Not`, `Tag`, `Correspondent`, `Type`, `StoragePath`, `Owner`, `MimeType` or `CustomField`", c)
+	}
+	if (c.All != nil && len(c.All) == 0) || (c.Any != nil && len(c.Any) == 0) {
+		return fmt.Errorf("condition %s must hold at least one condition", c)
+	}
+
+	for _, sub := range append(c.All, c.Any...) {
+		if err := sub.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return c.Not.validate()
+	}
+	if c.CustomField != nil {
+		return c.CustomField.validate()
+	}
+	return nil
+}
+
+// matches evaluates the condition against the document
+func (c condition) matches(d *documentData) bool {
+	switch {
+	case c.All != nil:
+		for _, sub := range c.All {
+			if !sub.matches(d) {
+				return false
+			}
+		}
+		return true
+	case c.Any != nil:
+		for _, sub := range c.Any {
+			if sub.matches(d) {
+				return true
+			}
+		}
+		return false
+	case c.Not != nil:
+		return !c.Not.matches(d)
+	case c.Tag != "":
+		return d.hasTagName(c.Tag)
+	case c.Correspondent != "":
+		return d.Correspondent != nil && d.Correspondent.Name == c.Correspondent
+	case c.Type != "":
+		return d.DocumentType != nil && d.DocumentType.Name == c.Type
+	case c.StoragePath != "":
+		return d.StoragePath != nil && d.StoragePath.Name == c.StoragePath
+	case c.Owner != "":
+		return d.Owner != nil && d.Owner.Username == c.Owner
+	case c.MimeType != "":
+		return matchesMimeType(c.MimeType, d.Document.OriginalMimeType)
+	case c.CustomField != nil:
+		return c.CustomField.matches(d)
+	}
+	// an empty condition matches every document
+	return true
+}
+
+// String returns a readable form of the condition for logging
+func (c condition) String() string {
+	join := func(conditions []condition, op string) string {
+		parts := make([]string, 0, len(conditions))
+		for _, sub := range conditions {
+			parts = append(parts, sub.String())
+		}
+		return "(" + strings.Join(parts, " "+op+" ") + ")"
+	}
+
+	switch {
+	case c.All != nil:
+		return join(c.All, "AND")
+	case c.Any != nil:
+		return join(c.Any, "OR")
+	case c.Not != nil:
+		return "NOT " + c.Not.String()
+	case c.Tag != "":
+		return fmt.Sprintf("Tag: %q", c.Tag)
+	case c.Correspondent != "":
+		return fmt.Sprintf("Correspondent: %q", c.Correspondent)
+	case c.Type != "":
+		return fmt.Sprintf("Type: %q", c.Type)
+	case c.StoragePath != "":
+		return fmt.Sprintf("StoragePath: %q", c.StoragePath)
+	case c.Owner != "":
+		return fmt.Sprintf("Owner: %q", c.Owner)
+	case c.MimeType != "":
+		return fmt.Sprintf("MimeType: %q", c.MimeType)
+	case c.CustomField != nil:
+		return c.CustomField.String()
+	}
+	return "()"
+}
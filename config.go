@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
@@ -13,39 +17,369 @@ var Config config
 
 // Struct for config validation using go-playground/validator
 type config struct {
-	Paperless Paperless `validate:"required"`
-	Email     struct {
-		SMTPAddress        string `validate:"required,email"`
-		SMTPServer         string `validate:"required,hostname"`
-		SMTPPort           string `validate:"required,min=1,max=65535"`
-		SMTPConnectionType string `validate:"required,oneof=starttls tls"`
-		SMTPUser           string `validate:"required"`
-		SMTPPassword       string `validate:"required"`
-		MailBody           string
-		MailHeader         string
+	Paperless        Paperless `validate:"required"`
+	Email            Email     `validate:"required"`
+	RunEveryXMinute  int       `validate:"required,min=-1,max=65535"`
+	SendLedgerPath   string
+	ShareLinkLogPath string
+	SendQuotaPath    string
+}
+
+type Email struct {
+	// the SMTP account of the default profile, it is used by all rules without SMTPProfile
+	SMTPAccount       `mapstructure:",squash"`
+	MailBody          string
+	MailHeader        string
+	BodyTemplate      string
+	PlainBodyTemplate string
+	OversizePolicy    string `validate:"omitempty,oneof=split link fail"`
+	// ReplyTo, CCAddresses and Headers are used by all rules, they are templates like the header
+	ReplyTo     []string       `validate:"dive,required"`
+	CCAddresses []string       `validate:"dive,required"`
+	Headers     []customHeader `validate:"dive"`
+	// AddressBook is a yaml file mapping names to addresses for the address template function
+	AddressBook string
+	// Profiles are additional SMTP accounts, rules select them by name
+	Profiles map[string]SMTPAccount `validate:"dive,keys,required,ne=default,endkeys,required"`
+}
+
+// defaultSMTPProfile is the name of the SMTP account configured directly in Email
+const defaultSMTPProfile = "default"
+
+// SMTPAccount is an SMTP profile, the server, credentials and sender mails are sent with
+type SMTPAccount struct {
+	SMTPAddress           string `validate:"required,email"`
+	FromName              string
+	SMTPServer            string `validate:"required,hostname"`
+	SMTPPort              string `validate:"required,min=1,max=65535"`
+	SMTPConnectionType    string `validate:"required,oneof=starttls tls plain none"`
+	SMTPUser              string
+	SMTPPassword          string
+	SMTPAllowInsecureAuth bool
+	SMTPAuthMechanism     string `validate:"omitempty,oneof=auto plain login cram-md5 xoauth2"`
+	SMTPOAuthTokenURL     string `validate:"required_if=SMTPAuthMechanism xoauth2,omitempty,url"`
+	SMTPOAuthClientID     string `validate:"required_if=SMTPAuthMechanism xoauth2"`
+	SMTPOAuthClientSecret string
+	SMTPOAuthRefreshToken string
+	SMTPOAuthScopes       []string
+	MaxMessageSizeMB      int `validate:"min=0"`
+	TLS                   TLSSettings
+	// MaxMessagesPerConnection limits the mails sent over one SMTP session
+	MaxMessagesPerConnection int `validate:"min=0"`
+	// rate limits of the account, 0 is unlimited
+	MaxMessagesPerMinute int `validate:"min=0"`
+	MaxMessagesPerHour   int `validate:"min=0"`
+	MaxMessagesPerDay    int `validate:"min=0"`
+}
+
+// getSMTPProfile returns the SMTP account of the profile, the default profile is the account of Email
+func (e Email) getSMTPProfile(name string) (SMTPAccount, bool) {
+	if name == defaultSMTPProfile {
+		return e.SMTPAccount, true
 	}
-	RunEveryXMinute int `validate:"required,min=-1,max=65535"`
+	account, ok := e.Profiles[name]
+	return account, ok
+}
+
+// getSMTPProfileNames returns the names of all SMTP profiles, the default profile first
+func (e Email) getSMTPProfileNames() []string {
+	names := make([]string, 0, len(e.Profiles))
+	for name := range e.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{defaultSMTPProfile}, names...)
+}
+
+// getAuthMechanism returns the configured SMTP auth mechanism, auto negotiates it with the server
+func (a SMTPAccount) getAuthMechanism() string {
+	if a.SMTPAuthMechanism != "" {
+		return a.SMTPAuthMechanism
+	}
+	return authAuto
+}
+
+// hasCredentials returns true if the account logs in to the SMTP server, relays may accept mails without login
+func (a SMTPAccount) hasCredentials() bool {
+	return a.SMTPUser != ""
+}
+
+// isEncrypted returns true if the connection type guarantees an encrypted connection
+func (a SMTPAccount) isEncrypted() bool {
+	return a.SMTPConnectionType == connectionTLS || a.SMTPConnectionType == connectionSTARTTLS
+}
+
+// getMaxMessagesPerConnection returns the number of mails sent over one SMTP session before it is replaced
+func (a SMTPAccount) getMaxMessagesPerConnection() int {
+	if a.MaxMessagesPerConnection > 0 {
+		return a.MaxMessagesPerConnection
+	}
+	return defaultMaxMessagesPerConnection
+}
+
+// getRateLimits returns the configured rate limits of the account
+func (a SMTPAccount) getRateLimits() []rateLimit {
+	var limits []rateLimit
+	if a.MaxMessagesPerMinute > 0 {
+		limits = append(limits, rateLimit{max: a.MaxMessagesPerMinute, window: time.Minute, name: "minute"})
+	}
+	if a.MaxMessagesPerHour > 0 {
+		limits = append(limits, rateLimit{max: a.MaxMessagesPerHour, window: time.Hour, name: "hour"})
+	}
+	if a.MaxMessagesPerDay > 0 {
+		limits = append(limits, rateLimit{max: a.MaxMessagesPerDay, window: 24 * time.Hour, name: "day"})
+	}
+	return limits
+}
+
+// getMaxMessageSize returns the maximum size of a mail in bytes, 0 is unlimited
+func (a SMTPAccount) getMaxMessageSize() int {
+	return a.MaxMessageSizeMB * 1024 * 1024
+}
+
+// getLedgerPath returns the path of the send ledger file
+func (c config) getLedgerPath() string {
+	if c.SendLedgerPath != "" {
+		return c.SendLedgerPath
+	}
+	return defaultLedgerPath
+}
+
+// getSendQuotaPath returns the path of the file that records the sent mails for the rate limits
+func (c config) getSendQuotaPath() string {
+	if c.SendQuotaPath != "" {
+		return c.SendQuotaPath
+	}
+	return defaultSendQuotaPath
+}
+
+// getShareLinkLogPath returns the path of the file that records sent share links
+func (c config) getShareLinkLogPath() string {
+	if c.ShareLinkLogPath != "" {
+		return c.ShareLinkLogPath
+	}
+	return defaultShareLinkLogPath
 }
 
 type Paperless struct {
-	InstanceURL             string `validate:"required,url"`
-	InstanceToken           string `validate:"required"`
-	AddQueueTagName         string `validate:"required"`
-	ProcessedTagName        string `validate:"required"`
-	UseCustomFilenameFormat bool
-	DownloadOriginal        bool   `validate:"boolean"`
-	Rules                   []rule `validate:"required,dive,required"`
+	InstanceURL                string `validate:"required,url"`
+	InstanceToken              string `validate:"required"`
+	AddQueueTagName            string
+	ProcessedTagName           string
+	UseCustomFilenameFormat    bool
+	DownloadOriginal           bool                `validate:"boolean"`
+	SetCustomFields            []customFieldUpdate `validate:"dive"`
+	RequestTimeoutSeconds      int                 `validate:"min=0"`
+	PageSize                   int                 `validate:"min=0"`
+	RetryMaxAttempts           int                 `validate:"min=0"`
+	RetryBaseDelayMilliseconds int                 `validate:"min=0"`
+	RetryMaxDelaySeconds       int                 `validate:"min=0"`
+	Rules                      []rule              `validate:"required,unique=Name,dive,required"`
+	TLS                        TLSSettings
 }
 
 type rule struct {
-	Name              string   `validate:"required"`
-	ReceiverAddresses []string `validate:"required,dive,required,email"`
-	BCCAddresses      []string `validate:"dive,required,email"`
+	Name string `validate:"required"`
+	// ReceiverAddresses and BCCAddresses are templates, so the receivers can be taken from the document
+	ReceiverAddresses []string `validate:"required,dive,required"`
+	BCCAddresses      []string `validate:"dive,required"`
 	MailBody          string
 	MailHeader        string
-	Tags              []string
-	Type              string
-	Correspondent     string
+	BodyTemplate      string
+	PlainBodyTemplate string
+	SetCustomFields   []customFieldUpdate `validate:"dive"`
+	Attachment        string              `validate:"omitempty,oneof=archive original both"`
+	// a digest rule sends all matching documents of a run or a window in one mail
+	Digest              bool
+	DigestWindowMinutes int `validate:"min=0"`
+	DigestZip           bool
+	DigestZipFileName   string
+	OversizePolicy      string `validate:"omitempty,oneof=split link fail"`
+	// Delivery link sends a paperless share link instead of attaching the files
+	Delivery            string `validate:"omitempty,oneof=attachment link"`
+	ShareLinkExpiryDays int    `validate:"min=-1"`
+	// SMTPProfile is the name of the profile in Email.Profiles the rule sends with
+	SMTPProfile string
+	// FromName, ReplyTo, CCAddresses and Headers are templates, they overwrite the ones of Config.Email
+	FromName         string
+	ReplyTo          []string       `validate:"dive,required"`
+	CCAddresses      []string       `validate:"dive,required"`
+	Headers          []customHeader `validate:"dive"`
+	Tags             []string
+	Condition        *condition
+	AddQueueTagName  string
+	ProcessedTagName string
+	Type             string
+	Correspondent    string
+}
+
+// getCondition combines Tags, Correspondent, Type and Condition of the rule, all of them have to match
+func (r rule) getCondition() condition {
+	var all []condition
+
+	for _, tag := range r.Tags {
+		all = append(all, condition{Tag: tag})
+	}
+	if r.Correspondent != "" {
+		all = append(all, condition{Correspondent: r.Correspondent})
+	}
+	if r.Type != "" {
+		all = append(all, condition{Type: r.Type})
+	}
+	if r.Condition != nil {
+		all = append(all, *r.Condition)
+	}
+
+	if len(all) == 1 {
+		return all[0]
+	}
+	return condition{All: all}
+}
+
+// getBodyTemplate returns the html body template of the rule and its name. The first one set of
+// BodyTemplate and MailBody of the rule and BodyTemplate and MailBody of Config.Email is used.
+func (r rule) getBodyTemplate() (string, string, error) {
+	switch {
+	case r.BodyTemplate != "":
+		body, err := readTemplateFile(r.BodyTemplate)
+		return body, r.BodyTemplate, err
+	case r.MailBody != "":
+		return r.MailBody, r.Name + "/MailBody", nil
+	case Config.Email.BodyTemplate != "":
+		body, err := readTemplateFile(Config.Email.BodyTemplate)
+		return body, Config.Email.BodyTemplate, err
+	}
+	return Config.Email.MailBody, r.Name + "/MailBody", nil
+}
+
+// getPlainBodyTemplate returns the optional plain text body template of the rule and its name.
+// The plain text template of Config.Email is only used if the rule does not set an own body.
+func (r rule) getPlainBodyTemplate() (string, string, error) {
+	path := r.PlainBodyTemplate
+	if path == "" && r.BodyTemplate == "" && r.MailBody == "" {
+		path = Config.Email.PlainBodyTemplate
+	}
+	if path == "" {
+		return "", "", nil
+	}
+
+	body, err := readTemplateFile(path)
+	return body, path, err
+}
+
+// getCustomFieldUpdates returns the custom fields to set after sending, the rule overwrites the global list
+func (r rule) getCustomFieldUpdates() []customFieldUpdate {
+	if len(r.SetCustomFields) > 0 {
+		return r.SetCustomFields
+	}
+	return Config.Paperless.SetCustomFields
+}
+
+// getAttachmentPolicy returns which files of a document are attached, without a rule setting
+// DownloadOriginal of Config.Paperless decides between the archived and the original file
+func (r rule) getAttachmentPolicy() string {
+	if r.Attachment != "" {
+		return r.Attachment
+	}
+	if Config.Paperless.DownloadOriginal {
+		return attachmentOriginal
+	}
+	return attachmentArchive
+}
+
+// getDigestZipFileName returns the filename of the ZIP attachment of a digest, a digest split into
+// several parts gets the part number appended, e.g. "documents-2.zip"
+func (r rule) getDigestZipFileName(part, parts int) string {
+	name := r.DigestZipFileName
+	if name == "" {
+		name = defaultDigestZipFileName
+	}
+	if parts > 1 {
+		ext := path.Ext(name)
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), part, ext)
+	}
+	return name
+}
+
+// getOversizePolicy returns what happens with a mail exceeding the maximum message size, the rule overwrites Config.Email
+func (r rule) getOversizePolicy() string {
+	if r.OversizePolicy != "" {
+		return r.OversizePolicy
+	}
+	if Config.Email.OversizePolicy != "" {
+		return Config.Email.OversizePolicy
+	}
+	return oversizeFail
+}
+
+// getDelivery returns if the rule attaches the files or sends a share link
+func (r rule) getDelivery() string {
+	if r.Delivery != "" {
+		return r.Delivery
+	}
+	return deliveryAttachment
+}
+
+// getShareLinkExpiryDays returns the days until a share link of the rule expires, -1 means it never expires
+func (r rule) getShareLinkExpiryDays() int {
+	if r.ShareLinkExpiryDays != 0 {
+		return r.ShareLinkExpiryDays
+	}
+	return defaultShareLinkExpiryDays
+}
+
+// getSMTPProfile returns the name of the SMTP profile the rule sends with
+func (r rule) getSMTPProfile() string {
+	if r.SMTPProfile != "" {
+		return r.SMTPProfile
+	}
+	return defaultSMTPProfile
+}
+
+// getFromName returns the display name of the sender, without a rule setting the one of the SMTP profile
+func (r rule) getFromName() string {
+	if r.FromName != "" {
+		return r.FromName
+	}
+	account, _ := Config.Email.getSMTPProfile(r.getSMTPProfile())
+	return account.FromName
+}
+
+// getReplyTo returns the Reply-To addresses, the rule overwrites the global list
+func (r rule) getReplyTo() []string {
+	if len(r.ReplyTo) > 0 {
+		return r.ReplyTo
+	}
+	return Config.Email.ReplyTo
+}
+
+// getCCAddresses returns the CC addresses, the rule overwrites the global list
+func (r rule) getCCAddresses() []string {
+	if len(r.CCAddresses) > 0 {
+		return r.CCAddresses
+	}
+	return Config.Email.CCAddresses
+}
+
+// getHeaders returns the custom headers of the mail, the global ones and the ones of the rule
+func (r rule) getHeaders() []customHeader {
+	return mergeHeaders(Config.Email.Headers, r.Headers)
+}
+
+// getQueueTagName returns the name of the tag that queues a document for the rule
+func (r rule) getQueueTagName() string {
+	if r.AddQueueTagName != "" {
+		return r.AddQueueTagName
+	}
+	return Config.Paperless.AddQueueTagName
+}
+
+// getProcessedTagName returns the name of the tag that marks a document as processed by the rule
+func (r rule) getProcessedTagName() string {
+	if r.ProcessedTagName != "" {
+		return r.ProcessedTagName
+	}
+	return Config.Paperless.ProcessedTagName
 }
 
 // Validate config using go-playground/validator
@@ -54,6 +388,8 @@ func validateWithPlayground(config config) error {
 
 	//custom validator to check if rule or paperless has at least a mailbody or header
 	validate.RegisterStructValidation(RuleValidation, rule{})
+	validate.RegisterStructValidation(SMTPAccountValidation, SMTPAccount{})
+	validate.RegisterStructValidation(CustomHeaderValidation, customHeader{})
 
 	err := validate.Struct(config)
 	if err != nil {
@@ -76,19 +412,72 @@ func RuleValidation(sl validator.StructLevel) {
 	p := sl.Top().Interface().(config)
 
 	// email body and header must be set in rule or config
-	if len(r.MailBody) == 0 && len(p.Email.MailBody) == 0 {
-		sl.ReportError(r.MailBody, "MailBody", "MailBody", "`MailBody` of rule or at least `Mailbody` of `Config.Email `must be set", "")
+	if len(r.MailBody) == 0 && len(r.BodyTemplate) == 0 && len(p.Email.MailBody) == 0 && len(p.Email.BodyTemplate) == 0 {
+		sl.ReportError(r.MailBody, "MailBody", "MailBody", "`MailBody` or `BodyTemplate` of rule or at least `Mailbody` or `BodyTemplate` of `Config.Email `must be set", "")
 	}
 
 	if len(r.MailHeader) == 0 && len(p.Email.MailHeader) == 0 {
 		sl.ReportError(r.MailHeader, "MailHeader", "MailHeader", "`MailHeader` of rule or at least `MailHeader` of `Config.Email` must be set", "")
 	}
 
-	// atleast tags, correspondent or type must be set in the rule
-	if len(r.Tags) == 0 && len(r.Correspondent) == 0 && len(r.Type) == 0 {
-		sl.ReportError(r, "", "rule", "At least one of `Tags`, `Correspondent` or `Type` must be set in the rule", "")
+	// every rule needs a queue tag, its own or the global one
+	if len(r.AddQueueTagName) == 0 && len(p.Paperless.AddQueueTagName) == 0 {
+		sl.ReportError(r.AddQueueTagName, "AddQueueTagName", "AddQueueTagName", "`AddQueueTagName` of rule or at least `AddQueueTagName` of `Config.Paperless` must be set", "")
+	}
+
+	// every rule needs a processed tag, its own or the global one
+	if len(r.ProcessedTagName) == 0 && len(p.Paperless.ProcessedTagName) == 0 {
+		sl.ReportError(r.ProcessedTagName, "ProcessedTagName", "ProcessedTagName", "`ProcessedTagName` of rule or at least `ProcessedTagName` of `Config.Paperless` must be set", "")
 	}
 
+	// atleast tags, correspondent, type, condition or an own queue tag must be set in the rule
+	if len(r.Tags) == 0 && len(r.Correspondent) == 0 && len(r.Type) == 0 && r.Condition == nil && len(r.AddQueueTagName) == 0 {
+		sl.ReportError(r, "", "rule", "At least one of `Tags`, `Correspondent`, `Type`, `Condition` or `AddQueueTagName` must be set in the rule", "")
+	}
+
+	// the SMTP profile must exist
+	if _, ok := p.Email.getSMTPProfile(r.getSMTPProfile()); !ok {
+		sl.ReportError(r.SMTPProfile, "SMTPProfile", "SMTPProfile", "`SMTPProfile` of rule must be a profile of `Config.Email.Profiles`", "")
+	}
+
+	// the condition tree must be well-formed
+	if r.Condition != nil {
+		if err := r.Condition.validate(); err != nil {
+			log.Printf("Validation failed on rule '%s': %v", r.Name, err)
+			sl.ReportError(r.Condition, "Condition", "Condition", "condition", "")
+		}
+	}
+
+}
+
+// SMTPAccountValidation custom validator to check the credentials of an SMTP profile
+func SMTPAccountValidation(sl validator.StructLevel) {
+	e := sl.Current().Interface().(SMTPAccount)
+
+	// credentials are optional, but a password or xoauth2 needs a user
+	if !e.hasCredentials() && (e.SMTPPassword != "" || e.SMTPAuthMechanism == authXOAuth2) {
+		sl.ReportError(e.SMTPUser, "SMTPUser", "SMTPUser", "required_with", "")
+	}
+	if e.hasCredentials() && e.SMTPPassword == "" && e.SMTPAuthMechanism != authXOAuth2 {
+		sl.ReportError(e.SMTPPassword, "SMTPPassword", "SMTPPassword", "required_with", "")
+	}
+
+	// credentials are only sent over a connection without guaranteed encryption with an explicit opt-in
+	if e.hasCredentials() && !e.isEncrypted() && !e.SMTPAllowInsecureAuth {
+		log.Printf("Validation failed: SMTP credentials would be sent over an unencrypted %s connection, set `SMTPAllowInsecureAuth` to allow it", e.SMTPConnectionType)
+		sl.ReportError(e.SMTPAllowInsecureAuth, "SMTPAllowInsecureAuth", "SMTPAllowInsecureAuth", "insecure_auth", "")
+	}
+}
+
+// CustomHeaderValidation custom validator to check the name of a custom header
+func CustomHeaderValidation(sl validator.StructLevel) {
+	h := sl.Current().Interface().(customHeader)
+
+	if !isHeaderName(h.Name) {
+		sl.ReportError(h.Name, "Name", "Name", "header name must be printable ASCII without spaces and colon", "")
+	} else if isReservedHeader(h.Name) {
+		sl.ReportError(h.Name, "Name", "Name", "header "+h.Name+" is set by the mail service and can't be a custom header", "")
+	}
 }
 
 // LoadConfig function to initialize config
@@ -116,11 +505,26 @@ func LoadConfig() {
 	if err := validateWithPlayground(Config); err != nil {
 		log.Fatalf("Struct validation failed: %v", err)
 	}
+
+	if err := loadAddressBook(); err != nil {
+		log.Fatalf("Loading address book failed: %v", err)
+	}
+
+	// Parse all templates, so a broken template fails at startup
+	if err := parseTemplates(); err != nil {
+		log.Fatalf("Template validation failed: %v", err)
+	}
+
+	if err := loadTLSConfigs(); err != nil {
+		log.Fatalf("Loading TLS settings failed: %v", err)
+	}
 }
 
 // PrintRules prints the current config to stdout
 func PrintRules() {
-	log.Printf("Documents with Tag %s at paperless will be marked for queuing", Config.Paperless.AddQueueTagName)
+	if len(Config.Paperless.AddQueueTagName) > 0 {
+		log.Printf("Documents with Tag %s at paperless will be marked for queuing by all rules without own queue tag", Config.Paperless.AddQueueTagName)
+	}
 
 	for _, rule := range Config.Paperless.Rules {
 		var l string
@@ -135,15 +539,44 @@ func PrintRules() {
 		if len(rule.Type) > 0 {
 			details = append(details, "Type: \""+rule.Type+"\"")
 		}
+		if rule.Condition != nil {
+			details = append(details, "Condition: "+rule.Condition.String())
+		}
+		if len(rule.AddQueueTagName) > 0 {
+			details = append(details, "queued by Tag: \""+rule.AddQueueTagName+"\"")
+		}
+		if rule.getDelivery() == deliveryLink {
+			details = append(details, fmt.Sprintf("as share link expiring after %d day(s)", rule.getShareLinkExpiryDays()))
+		} else if len(rule.Attachment) > 0 {
+			details = append(details, "attaching: "+rule.Attachment)
+		}
+		if rule.Digest {
+			digest := "as digest"
+			if rule.DigestWindowMinutes > 0 {
+				digest += fmt.Sprintf(" every %d minute(s)", rule.DigestWindowMinutes)
+			}
+			if rule.DigestZip {
+				digest += " in " + rule.getDigestZipFileName(1, 1)
+			}
+			details = append(details, digest)
+		}
+		if len(rule.SMTPProfile) > 0 {
+			details = append(details, "from SMTP profile: \""+rule.SMTPProfile+"\"")
+		}
 		l += strings.Join(details, ", ")
 		l += " to Address(es): \"" + strings.Join(rule.ReceiverAddresses, ",") + "\" "
 		if len(rule.BCCAddresses) > 0 {
-			l += "and Bcc to: \"" + strings.Join(rule.BCCAddresses, ",") + "\""
+			l += "and Bcc to: \"" + strings.Join(rule.BCCAddresses, ",") + "\" "
+		}
+		if len(rule.ProcessedTagName) > 0 {
+			l += "and mark them with Tag: \"" + rule.ProcessedTagName + "\""
 		}
 
 		log.Printf("Found Rule \"%s\": Send Documents with %s", rule.Name, l)
 	}
 
-	log.Printf("All processed documents will be marked with Tag: %s at paperless", Config.Paperless.ProcessedTagName)
+	if len(Config.Paperless.ProcessedTagName) > 0 {
+		log.Printf("All processed documents of rules without own processed tag will be marked with Tag: %s at paperless", Config.Paperless.ProcessedTagName)
+	}
 
 }
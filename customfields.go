@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// customFieldValue is a custom field of a document together with its definition
+type customFieldValue struct {
+	Field paperless.CustomField
+	Value any
+}
+
+// newCustomFieldValues resolves the custom field instances of a document with the field definitions.
+// Instances of unknown fields are skipped.
+func newCustomFieldValues(instances []paperless.CustomFieldInstance, customFields []paperless.CustomField) []customFieldValue {
+	var values []customFieldValue
+	for _, instance := range instances {
+		field := paperless.CustomFieldByID(customFields, instance.Field)
+		if field == nil {
+			continue
+		}
+		values = append(values, customFieldValue{Field: *field, Value: instance.Value})
+	}
+	return values
+}
+
+// Text returns the value as text. Select options are resolved to their label, document links
+// are joined by comma and an empty field returns an empty string.
+func (v customFieldValue) Text() string {
+	switch value := v.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		if v.Field.DataType == "select" {
+			for _, option := range v.Field.ExtraData.SelectOptions {
+				if option.ID == value {
+					return option.Label
+				}
+			}
+		}
+		return value
+	case float64:
+		// older paperless versions reference select options by index
+		if v.Field.DataType == "select" {
+			if idx := int(value); idx >= 0 && idx < len(v.Field.ExtraData.SelectOptions) {
+				return v.Field.ExtraData.SelectOptions[idx].Label
+			}
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case []any:
+		parts := make([]string, 0, len(value))
+		for _, item := range value {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// getCustomField returns the custom field of the document with the name
+func (d *documentData) getCustomField(name string) (customFieldValue, bool) {
+	for _, value := range d.CustomFields {
+		if value.Field.Name == name {
+			return value, true
+		}
+	}
+	return customFieldValue{}, false
+}
+
+// customFieldCondition compares the value of a custom field. All comparisons that are set have to match,
+// e.g. GreaterThan and LessOrEqual form a range. A document without a value for the field never matches.
+type customFieldCondition struct {
+	Name           string
+	IsSet          bool
+	Equals         string
+	In             []string
+	GreaterThan    string
+	GreaterOrEqual string
+	LessThan       string
+	LessOrEqual    string
+}
+
+// validate checks that the field name and at least one comparison are set
+func (c customFieldCondition) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("custom field condition must set `Name`")
+	}
+	if !c.IsSet && c.Equals == "" && len(c.In) == 0 && c.GreaterThan == "" && c.GreaterOrEqual == "" && c.LessThan == "" && c.LessOrEqual == "" {
+		return fmt.Errorf("custom field condition %q must set at least one of `IsSet`, `Equals`, `In`, `GreaterThan`, `GreaterOrEqual`, `LessThan` or `LessOrEqual`", c.Name)
+	}
+	return nil
+}
+
+// matches evaluates the condition against the custom fields of the document
+func (c customFieldCondition) matches(d *documentData) bool {
+	field, ok := d.getCustomField(c.Name)
+	if !ok {
+		return false
+	}
+	value := field.Text()
+	if value == "" {
+		return false
+	}
+
+	if c.Equals != "" && compareCustomFieldValues(field.Field.DataType, value, c.Equals) != 0 {
+		return false
+	}
+
+	if len(c.In) > 0 {
+		found := false
+		for _, candidate := range c.In {
+			if compareCustomFieldValues(field.Field.DataType, value, candidate) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if c.GreaterThan != "" && compareCustomFieldValues(field.Field.DataType, value, c.GreaterThan) <= 0 {
+		return false
+	}
+	if c.GreaterOrEqual != "" && compareCustomFieldValues(field.Field.DataType, value, c.GreaterOrEqual) < 0 {
+		return false
+	}
+	if c.LessThan != "" && compareCustomFieldValues(field.Field.DataType, value, c.LessThan) >= 0 {
+		return false
+	}
+	if c.LessOrEqual != "" && compareCustomFieldValues(field.Field.DataType, value, c.LessOrEqual) > 0 {
+		return false
+	}
+	return true
+}
+
+// String returns a readable form of the condition for logging
+func (c customFieldCondition) String() string {
+	var parts []string
+	if c.IsSet {
+		parts = append(parts, "is set")
+	}
+	if c.Equals != "" {
+		parts = append(parts, fmt.Sprintf("= %q", c.Equals))
+	}
+	if len(c.In) > 0 {
+		parts = append(parts, fmt.Sprintf("in %q", c.In))
+	}
+	if c.GreaterThan != "" {
+		parts = append(parts, "> "+c.GreaterThan)
+	}
+	if c.GreaterOrEqual != "" {
+		parts = append(parts, ">= "+c.GreaterOrEqual)
+	}
+	if c.LessThan != "" {
+		parts = append(parts, "< "+c.LessThan)
+	}
+	if c.LessOrEqual != "" {
+		parts = append(parts, "<= "+c.LessOrEqual)
+	}
+	return fmt.Sprintf("CustomField %q %s", c.Name, strings.Join(parts, " and "))
+}
+
+// compareCustomFieldValues compares two values according to the data type of the field. Integer, float and
+// monetary fields are compared as numbers, date fields as dates (YYYY-MM-DD) and all others as text.
+// Values that can't be parsed for the data type are compared as text as well.
+func compareCustomFieldValues(dataType, a, b string) int {
+	switch dataType {
+	case "integer", "float":
+		if x, err := strconv.ParseFloat(strings.TrimSpace(a), 64); err == nil {
+			if y, err := strconv.ParseFloat(strings.TrimSpace(b), 64); err == nil {
+				return compareNumbers(x, y)
+			}
+		}
+	case "monetary":
+		currencyA, x, errA := parseMonetary(a)
+		currencyB, y, errB := parseMonetary(b)
+		// amounts in different currencies are never equal
+		if errA == nil && errB == nil && (currencyA == "" || currencyB == "" || currencyA == currencyB) {
+			return compareNumbers(x, y)
+		}
+	case "date":
+		if x, err := time.Parse(time.DateOnly, strings.TrimSpace(a)); err == nil {
+			if y, err := time.Parse(time.DateOnly, strings.TrimSpace(b)); err == nil {
+				return x.Compare(y)
+			}
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+// compareNumbers returns -1, 0 or 1 like strings.Compare
+func compareNumbers(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// parseMonetary splits a monetary value into the optional 3-letter ISO currency code, which paperless
+// puts in front of the amount (e.g. "EUR1000.00"), and the amount
+func parseMonetary(s string) (string, float64, error) {
+	s = strings.TrimSpace(s)
+	currency := ""
+	if len(s) >= 3 && isCurrencyCode(s[:3]) {
+		currency, s = s[:3], s[3:]
+	}
+	amount, err := strconv.ParseFloat(s, 64)
+	return currency, amount, err
+}
+
+// isCurrencyCode returns true for three uppercase letters
+func isCurrencyCode(s string) bool {
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return len(s) == 3
+}
+
+// customFieldUpdate sets the custom field with the name to the value after a document was sent
+type customFieldUpdate struct {
+	Name  string `validate:"required"`
+	Value string
+}
+
+// prepareCustomFieldUpdates converts the configured updates with their rendered values into custom field instances for paperless.
+// Updates of unknown fields or with values not matching the data type are skipped with a warning.
+func prepareCustomFieldUpdates(updates []customFieldUpdate, values []string, customFields []paperless.CustomField, ruleName string) []paperless.CustomFieldInstance {
+	var instances []paperless.CustomFieldInstance
+
+	for idx, update := range updates {
+		field := paperless.CustomFieldByName(customFields, update.Name)
+		if field == nil {
+			log.Printf("warning: custom field %q of rule %s does not exist in paperless, it is not updated", update.Name, ruleName)
+			continue
+		}
+
+		text := values[idx]
+		value, err := customFieldInputValue(*field, text)
+		if err != nil {
+			log.Printf("warning: custom field %q of rule %s is not updated: %v", update.Name, ruleName, err)
+			continue
+		}
+		instances = append(instances, paperless.CustomFieldInstance{Field: field.ID, Value: value})
+	}
+	return instances
+}
+
+// customFieldInputValue converts the text into the value paperless expects for the data type of the field.
+// An empty text clears the field.
+func customFieldInputValue(field paperless.CustomField, text string) (any, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	switch field.DataType {
+	case "integer":
+		return strconv.Atoi(text)
+	case "float":
+		return strconv.ParseFloat(text, 64)
+	case "boolean":
+		return strconv.ParseBool(text)
+	case "date":
+		if _, err := time.Parse(time.DateOnly, text); err != nil {
+			return nil, fmt.Errorf("%q is not a date (YYYY-MM-DD)", text)
+		}
+		return text, nil
+	case "select":
+		for idx, option := range field.ExtraData.SelectOptions {
+			if option.Label == text {
+				// older paperless versions reference select options by index
+				if option.ID == "" {
+					return idx, nil
+				}
+				return option.ID, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not an option of the select field", text)
+	}
+	return text, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+func TestCompareCustomFieldValues(t *testing.T) {
+	tests := []struct {
+		dataType string
+		a, b     string
+		want     int
+	}{
+		{"monetary", "EUR1000.00", "1000", 0},
+		{"monetary", "EUR1000.00", "EUR999.99", 1},
+		{"monetary", "EUR50", "EUR100", -1},
+		{"monetary", "1000.00", "EUR1000", 0},
+		{"monetary", "EUR100", "USD100", -1},
+		{"integer", "9", "10", -1},
+		{"integer", "10", "10.0", 0},
+		{"float", "2.5", "2.50", 0},
+		{"float", "abc", "2.5", 1},
+		{"date", "2024-12-31", "2025-01-01", -1},
+		{"date", "2024-12-31", "2024-12-31", 0},
+		{"select", "KST100", "ABC100", 1},
+		{"select", "A1", "B1", -1},
+		{"string", "E5", "5", 1},
+		{"string", "DE01", "AT01", 1},
+		{"string", "10", "9", -1},
+		{"string", "Acme", "Acme", 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareCustomFieldValues(tt.dataType, tt.a, tt.b); got != tt.want {
+			t.Errorf("compareCustomFieldValues(%q, %q, %q) = %d, want %d", tt.dataType, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCustomFieldConditionMatches(t *testing.T) {
+	costCenter := paperless.CustomField{ID: 1, Name: "Cost Center", DataType: "select"}
+	costCenter.ExtraData.SelectOptions = []paperless.SelectOption{{ID: "a", Label: "A1"}, {ID: "b", Label: "B1"}}
+	fields := []paperless.CustomField{
+		costCenter,
+		{ID: 2, Name: "Amount", DataType: "monetary"},
+		{ID: 3, Name: "Country", DataType: "string"},
+		{ID: 4, Name: "Due", DataType: "date"},
+		{ID: 5, Name: "Pages", DataType: "integer"},
+	}
+	doc := &paperless.Document{CustomFields: []paperless.CustomFieldInstance{
+		{Field: 1, Value: "b"},
+		{Field: 2, Value: "EUR1500.00"},
+		{Field: 3, Value: "AT01"},
+		{Field: 4, Value: "2024-06-30"},
+		{Field: 5, Value: float64(12)},
+	}}
+	data := &documentData{Document: doc, CustomFields: newCustomFieldValues(doc.CustomFields, fields)}
+
+	tests := []struct {
+		name      string
+		condition customFieldCondition
+		want      bool
+	}{
+		{"select equals label", customFieldCondition{Name: "Cost Center", Equals: "B1"}, true},
+		{"select other label with same digits", customFieldCondition{Name: "Cost Center", Equals: "A1"}, false},
+		{"text in", customFieldCondition{Name: "Country", In: []string{"DE01", "CH01"}}, false},
+		{"text in match", customFieldCondition{Name: "Country", In: []string{"DE01", "AT01"}}, true},
+		{"monetary range", customFieldCondition{Name: "Amount", GreaterThan: "1000", LessOrEqual: "EUR1500"}, true},
+		{"monetary above", customFieldCondition{Name: "Amount", GreaterThan: "EUR1500"}, false},
+		{"monetary other currency", customFieldCondition{Name: "Amount", Equals: "USD1500"}, false},
+		{"date before", customFieldCondition{Name: "Due", LessThan: "2024-07-01"}, true},
+		{"date after", customFieldCondition{Name: "Due", GreaterOrEqual: "2024-07-01"}, false},
+		{"integer as number", customFieldCondition{Name: "Pages", GreaterThan: "9"}, true},
+		{"is set", customFieldCondition{Name: "Country", IsSet: true}, true},
+		{"unknown field", customFieldCondition{Name: "Missing", IsSet: true}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.condition.matches(data); got != tt.want {
+			t.Errorf("%s: %s matches = %v, want %v", tt.name, tt.condition, got, tt.want)
+		}
+	}
+}
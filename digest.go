@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// defaultDigestZipFileName is the name of the ZIP attachment if a digest rule sets no name
+const defaultDigestZipFileName = "documents.zip"
+
+// digestItem is a document collected for the digest of a rule
+type digestItem struct {
+	doc   *paperless.Document
+	data  *documentData
+	group *processedTagGroup
+	// since is the time the document was collected first, it is only tracked for digests with a window
+	since time.Time
+	// shareLink is created for rules with link delivery right before sending
+	shareLink *paperless.ShareLink
+}
+
+// digestBatch holds the documents of a run that are sent together by a digest rule
+type digestBatch struct {
+	rule  rule
+	items []digestItem
+}
+
+// getDigestBatch returns the batch of the rule and adds it to batches if it does not exist yet
+func getDigestBatch(batches *[]*digestBatch, r rule) *digestBatch {
+	for _, batch := range *batches {
+		if batch.rule.Name == r.Name {
+			return batch
+		}
+	}
+	batch := &digestBatch{rule: r}
+	*batches = append(*batches, batch)
+	return batch
+}
+
+// sendDigest sends the collected documents of a digest rule in one mail. A rule with a window waits until
+// its oldest document was collected DigestWindowMinutes ago, until then the documents stay in the queue.
+// The processed tag groups of the documents are marked as failed or deferred if they were not sent.
+func sendDigest(ctx context.Context, client paperless.Client, ledger *SendLedger, mailer *Mailer, batch *digestBatch, customFields []paperless.CustomField) {
+	r := batch.rule
+
+	if r.DigestWindowMinutes > 0 {
+		now := time.Now()
+		oldest := now
+		for idx := range batch.items {
+			item := &batch.items[idx]
+			if item.since.IsZero() {
+				item.since = now
+				if err := ledger.MarkPending(*item.doc, r.Name, item.since); err != nil {
+					log.Printf("error recording document '%s' (%d) for digest of rule %s: %v", getFileName(item.doc), item.doc.ID, r.Name, err)
+				}
+			}
+			if item.since.Before(oldest) {
+				oldest = item.since
+			}
+		}
+
+		if due := oldest.Add(time.Duration(r.DigestWindowMinutes) * time.Minute); now.Before(due) {
+			log.Printf("digest of rule %s holds %d document(s), it is sent at %s", r.Name, len(batch.items), due.Format(time.RFC3339))
+			for _, item := range batch.items {
+				item.group.deferred = true
+			}
+			return
+		}
+	}
+
+	// documents over the send quota are not downloaded, the digest is sent by a later run
+	if err := mailer.checkQuota(1); err != nil {
+		log.Printf("digest of rule %s with %d document(s) is deferred: %v", r.Name, len(batch.items), err)
+		for _, item := range batch.items {
+			item.group.deferred = true
+		}
+		return
+	}
+
+	if err := sendDigestMail(ctx, client, ledger, mailer, batch, customFields); err != nil {
+		var exceeded *quotaExceededError
+		if errors.As(err, &exceeded) {
+			log.Printf("digest of rule %s is deferred: %v", r.Name, err)
+			for _, item := range batch.items {
+				if !item.group.failed {
+					item.group.deferred = true
+				}
+			}
+			return
+		}
+		log.Printf("error sending digest of rule %s: %v", r.Name, err)
+		for _, item := range batch.items {
+			item.group.failed = true
+		}
+	}
+}
+
+// sendDigestMail downloads the documents of the batch and sends them in one mail. Documents that can't be
+// downloaded are left out and stay in the queue. A digest exceeding the maximum message size is sent
+// according to the oversize policy of the rule.
+func sendDigestMail(ctx context.Context, client paperless.Client, ledger *SendLedger, mailer *Mailer, batch *digestBatch, customFields []paperless.CustomField) error {
+	r := batch.rule
+
+	var items []digestItem
+	// files holds the attachments of every item
+	var files [][]mailAttachment
+	for _, item := range batch.items {
+		if r.getDelivery() == deliveryLink {
+			link, err := createShareLink(ctx, client, item.doc, r)
+			if err != nil {
+				log.Printf("%v, it is not part of the digest of rule %s", err, r.Name)
+				item.group.failed = true
+				continue
+			}
+			item.shareLink = &link
+			items = append(items, item)
+			files = append(files, nil)
+			continue
+		}
+
+		attachments, err := downloadAttachments(ctx, client, item.doc, r.getAttachmentPolicy())
+		if err != nil {
+			log.Printf("failed to download document: '%s' (%d), it is not part of the digest of rule %s: %v", getFileName(item.doc), item.doc.ID, r.Name, err)
+			item.group.failed = true
+			continue
+		}
+		items = append(items, item)
+		files = append(files, attachments)
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no document could be downloaded")
+	}
+
+	err := sendDigestPart(ctx, client, ledger, mailer, r, items, files, 1, 1, false, customFields)
+
+	// a digest of share links has no attachments to split or replace
+	var tooLarge *messageTooLargeError
+	if !errors.As(err, &tooLarge) || r.getDelivery() == deliveryLink {
+		return err
+	}
+	log.Printf("digest of rule %s: %v, sending it with oversize policy %s", r.Name, err, r.getOversizePolicy())
+
+	switch r.getOversizePolicy() {
+	case oversizeLink:
+		return sendDigestPart(ctx, client, ledger, mailer, r, items, files, 1, 1, true, customFields)
+	case oversizeSplit:
+		// the body listing all documents is larger than the body of a part, so it is a safe estimate
+		mail, err := renderMail(r, newDigestTemplateData(items, r, time.Now()))
+		if err != nil {
+			return err
+		}
+
+		parts, oversized := packParts(files, estimatedBaseSize(mail), tooLarge.Limit)
+		for _, idx := range oversized {
+			log.Printf("error sending document '%s' (%d) with digest of rule %s: it exceeds the maximum message size of %s on its own",
+				getFileName(items[idx].doc), items[idx].doc.ID, r.Name, formatSize(tooLarge.Limit))
+			items[idx].group.failed = true
+		}
+
+		// every part is recorded on its own, so a failing part does not resend the others
+		for partIdx, part := range parts {
+			var partItems []digestItem
+			var partFiles [][]mailAttachment
+			for _, idx := range part {
+				partItems = append(partItems, items[idx])
+				partFiles = append(partFiles, files[idx])
+			}
+
+			if err := sendDigestPart(ctx, client, ledger, mailer, r, partItems, partFiles, partIdx+1, len(parts), false, customFields); err != nil {
+				// parts over the send quota are deferred, their documents form a new digest with a later run
+				var exceeded *quotaExceededError
+				if errors.As(err, &exceeded) {
+					log.Printf("part %d of %d of digest of rule %s is deferred: %v", partIdx+1, len(parts), r.Name, err)
+					for _, item := range partItems {
+						item.group.deferred = true
+					}
+					continue
+				}
+				log.Printf("error sending part %d of %d of digest of rule %s: %v", partIdx+1, len(parts), r.Name, err)
+				for _, item := range partItems {
+					item.group.failed = true
+				}
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// sendDigestPart sends the items in one mail, it is the whole digest or a numbered part of it. With links
+// the documents are not attached but linked in the body.
+func sendDigestPart(ctx context.Context, client paperless.Client, ledger *SendLedger, mailer *Mailer, r rule, items []digestItem, files [][]mailAttachment, part, parts int, links bool, customFields []paperless.CustomField) error {
+	sentAt := time.Now()
+
+	// share links of a mail that was not sent are revoked
+	sent := false
+	defer func() {
+		for _, item := range items {
+			if item.shareLink != nil && !sent {
+				revokeShareLink(ctx, client, *item.shareLink)
+			}
+		}
+	}()
+
+	var attachments []mailAttachment
+	if !links {
+		for _, f := range files {
+			attachments = append(attachments, f...)
+		}
+		makeFileNamesUnique(attachments)
+
+		if r.DigestZip {
+			archive, err := zipAttachments(r.getDigestZipFileName(part, parts), attachments)
+			if err != nil {
+				return err
+			}
+			attachments = []mailAttachment{archive}
+		}
+	}
+
+	data := newDigestTemplateData(items, r, sentAt)
+	data.Part, data.PartCount = part, parts
+	mail, err := renderMail(r, data)
+	if err != nil {
+		return err
+	}
+	mail = withPartHeader(mail, part, parts)
+	if links {
+		docs := make([]*paperless.Document, 0, len(items))
+		for _, item := range items {
+			docs = append(docs, item.doc)
+		}
+		mail = withDocumentLinks(mail, docs)
+	}
+
+	// custom field values are rendered per document before sending, so a broken value does not fail after the mail is out
+	fieldUpdates := make([][]paperless.CustomFieldInstance, len(items))
+	for idx, item := range items {
+		values, err := renderCustomFieldValues(r, newTemplateData(item.data, r, sentAt).withReceivers(mail))
+		if err != nil {
+			return err
+		}
+		fieldUpdates[idx] = prepareCustomFieldUpdates(r.getCustomFieldUpdates(), values, customFields, r.Name)
+	}
+
+	for _, item := range items {
+		if err := ledger.MarkSending(*item.doc, r.Name); err != nil {
+			return fmt.Errorf("could not record document '%s' (%d) in send ledger: %v", getFileName(item.doc), item.doc.ID, err)
+		}
+	}
+
+	if err := sendMail(mailer, mail, attachments); err != nil {
+		// the mail was not accepted, so the documents can be sent again with the next run
+		for _, item := range items {
+			var cleanupErr error
+			if item.since.IsZero() {
+				cleanupErr = ledger.Remove(*item.doc, r.Name)
+			} else {
+				// keep the window, so the digest is retried with the next run
+				cleanupErr = ledger.MarkPending(*item.doc, r.Name, item.since)
+			}
+			if cleanupErr != nil {
+				log.Printf("error cleaning up send ledger: %v", cleanupErr)
+			}
+		}
+		return err
+	}
+	sent = true
+
+	for idx, item := range items {
+		if item.shareLink != nil {
+			if err := recordShareLink(*item.shareLink, r.Name); err != nil {
+				log.Printf("warning: share link %d of document '%s' (%d) was sent, but could not be recorded: %v", item.shareLink.ID, getFileName(item.doc), item.doc.ID, err)
+			}
+		}
+
+		if err := ledger.MarkSent(*item.doc, r.Name); err != nil {
+			log.Printf("document '%s' (%d) was sent, but could not be recorded in send ledger: %v", getFileName(item.doc), item.doc.ID, err)
+			item.group.failed = true
+		}
+
+		// the mail is sent, a failing update is only logged
+		if len(fieldUpdates[idx]) > 0 {
+			values, err := client.UpdateCustomFields(ctx, *item.doc, fieldUpdates[idx])
+			if err != nil {
+				log.Printf("warning: could not update custom fields of document '%s' (%d): %v", getFileName(item.doc), item.doc.ID, err)
+			} else {
+				item.doc.CustomFields = values
+				item.data.CustomFields = newCustomFieldValues(values, customFields)
+			}
+		}
+	}
+
+	if parts > 1 {
+		log.Printf("part %d of %d of digest of rule %s with %d document(s) successfully sent to %s", part, parts, r.Name, len(items), formatReceivers(mail))
+	} else {
+		log.Printf("digest of rule %s with %d document(s) successfully sent to %s", r.Name, len(items), formatReceivers(mail))
+	}
+	return nil
+}
+
+// makeFileNamesUnique numbers attachments with the same filename, e.g. "Invoice (2).pdf"
+func makeFileNamesUnique(attachments []mailAttachment) {
+	seen := make(map[string]int)
+	for idx := range attachments {
+		name := attachments[idx].Filename
+		key := strings.ToLower(name)
+		seen[key]++
+		if seen[key] == 1 {
+			continue
+		}
+
+		ext := path.Ext(name)
+		if !isFileExtension(ext) {
+			ext = ""
+		}
+		for n := seen[key]; ; n++ {
+			candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+			if _, ok := seen[strings.ToLower(candidate)]; !ok {
+				seen[strings.ToLower(candidate)] = 1
+				attachments[idx].Filename = candidate
+				break
+			}
+		}
+	}
+}
+
+// zipAttachments packs the attachments into a single ZIP attachment
+func zipAttachments(filename string, attachments []mailAttachment) (mailAttachment, error) {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+
+	for _, attachment := range attachments {
+		f, err := w.CreateHeader(&zip.FileHeader{
+			Name:     attachment.Filename,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return mailAttachment{}, fmt.Errorf("failed to add %s to zip: %v", attachment.Filename, err)
+		}
+		if _, err := f.Write(attachment.Data); err != nil {
+			return mailAttachment{}, fmt.Errorf("failed to add %s to zip: %v", attachment.Filename, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return mailAttachment{}, fmt.Errorf("failed to create zip: %v", err)
+	}
+
+	return mailAttachment{Filename: filename, ContentType: "application/zip", Data: b.Bytes()}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// customHeader is an additional header field of the mail, the value is a template
+type customHeader struct {
+	Name  string `validate:"required"`
+	Value string
+}
+
+// reservedHeaders are written by the mail service itself and can't be set as custom headers
+var reservedHeaders = []string{
+	"Bcc", "Cc", "Content-Transfer-Encoding", "Content-Type", "Date", "From", "Message-ID",
+	"MIME-Version", "Reply-To", "Return-Path", "Sender", "Subject", "To",
+}
+
+// isHeaderName returns true if name is a valid header field name, printable ASCII without colon, see RFC 5322
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// isReservedHeader returns true if the header is written by the mail service itself
+func isReservedHeader(name string) bool {
+	for _, reserved := range reservedHeaders {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeHeaders returns the global headers followed by the headers of the rule, a rule header replaces a global one with the same name
+func mergeHeaders(global, headers []customHeader) []customHeader {
+	var merged []customHeader
+	for _, g := range global {
+		replaced := false
+		for _, h := range headers {
+			if strings.EqualFold(g.Name, h.Name) {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, g)
+		}
+	}
+	return append(merged, headers...)
+}
+
+// parseRenderedAddresses parses rendered address templates, every value may hold a comma separated list.
+// Values that render empty are skipped, e.g. if the document has no correspondent.
+func parseRenderedAddresses(values []string) ([]mail.Address, error) {
+	var addresses []mail.Address
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", value, err)
+		}
+		for _, address := range list {
+			addresses = append(addresses, *address)
+		}
+	}
+	return addresses, nil
+}
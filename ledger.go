@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// defaultLedgerPath is used if no path for the send ledger is configured
+const defaultLedgerPath = "config/send_ledger.json"
+
+// states of a ledger entry
+const (
+	// ledgerStateSending is written right before the mail is handed to the SMTP server.
+	// If the service crashes during sending, the entry stays in this state and the outcome is unknown.
+	ledgerStateSending = "sending"
+	// ledgerStateSent is written after the SMTP server accepted the mail
+	ledgerStateSent = "sent"
+	// ledgerStatePending is written when a digest rule with a window collects the document. The time of the
+	// entry is the time it was collected first, it starts the window of the digest.
+	ledgerStatePending = "pending"
+)
+
+// LedgerEntry records the delivery of one document by one rule
+type LedgerEntry struct {
+	DocumentID int       `json:"document_id"`
+	Rule       string    `json:"rule"`
+	Checksum   string    `json:"checksum"`
+	State      string    `json:"state"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SendLedger is a small persistent store of sent documents. It closes the gap between the SMTP
+// server accepting a mail and the processed tag being added in paperless, so a failing tag
+// update or a crash never leads to the same mail being sent twice.
+// Once the processed tag of a rule is set, paperless is the source of truth and the entry is removed.
+type SendLedger struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]LedgerEntry
+}
+
+// OpenSendLedger loads the ledger from path, a missing file results in an empty ledger
+func OpenSendLedger(path string) (*SendLedger, error) {
+	l := &SendLedger{
+		path:    path,
+		entries: make(map[string]LedgerEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read send ledger %s: %v", path, err)
+	}
+
+	var entries []LedgerEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse send ledger %s: %v", path, err)
+	}
+
+	for _, e := range entries {
+		l.entries[ledgerKey(e.DocumentID, e.Rule, e.Checksum)] = e
+	}
+	return l, nil
+}
+
+// ledgerKey builds the key of an entry. The checksum is part of the key, so a document
+// with replaced content is sent again.
+func ledgerKey(documentID int, rule, checksum string) string {
+	return fmt.Sprintf("%d/%s/%s", documentID, rule, checksum)
+}
+
+// Get returns the entry of the document and rule, if one exists
+func (l *SendLedger) Get(doc paperless.Document, rule string) (LedgerEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[ledgerKey(doc.ID, rule, doc.Checksum())]
+	return e, ok
+}
+
+// MarkPending records that the document waits for the digest of the rule since the given time
+func (l *SendLedger) MarkPending(doc paperless.Document, rule string, since time.Time) error {
+	return l.setAt(doc, rule, ledgerStatePending, since)
+}
+
+// MarkSending records that the document is about to be sent by the rule
+func (l *SendLedger) MarkSending(doc paperless.Document, rule string) error {
+	return l.set(doc, rule, ledgerStateSending)
+}
+
+// MarkSent records that the mail of the document and rule was accepted by the SMTP server
+func (l *SendLedger) MarkSent(doc paperless.Document, rule string) error {
+	return l.set(doc, rule, ledgerStateSent)
+}
+
+// Remove deletes the entry of the document and rule, e.g. if sending failed for sure or the processed tag was set
+func (l *SendLedger) Remove(doc paperless.Document, rule string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, ledgerKey(doc.ID, rule, doc.Checksum()))
+	return l.save()
+}
+
+func (l *SendLedger) set(doc paperless.Document, rule, state string) error {
+	return l.setAt(doc, rule, state, time.Now())
+}
+
+func (l *SendLedger) setAt(doc paperless.Document, rule, state string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[ledgerKey(doc.ID, rule, doc.Checksum())] = LedgerEntry{
+		DocumentID: doc.ID,
+		Rule:       rule,
+		Checksum:   doc.Checksum(),
+		State:      state,
+		UpdatedAt:  at,
+	}
+	return l.save()
+}
+
+// save writes the ledger, see writeFileAtomic
+func (l *SendLedger) save() error {
+	entries := make([]LedgerEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].DocumentID != entries[j].DocumentID {
+			return entries[i].DocumentID < entries[j].DocumentID
+		}
+		return entries[i].Rule < entries[j].Rule
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode send ledger: %v", err)
+	}
+
+	if err := writeFileAtomic(l.path, data); err != nil {
+		return fmt.Errorf("failed to write send ledger: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file, syncs it and renames it to path,
+// so the file is never half written, not even by a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -1,245 +1,283 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/base64"
 	"fmt"
-	"mime/quotedprintable"
+	"log"
+	"net/mail"
 	"net/smtp"
-	"strings"
-	"time"
-
-	"github.com/k3a/html2text"
+	"strconv"
 )
 
-func toQuotedPrintable(s string) (string, error) {
-	var ac bytes.Buffer
-	w := quotedprintable.NewWriter(&ac)
-	defer w.Close()
-
-	if _, err := w.Write([]byte(s)); err != nil {
-		return "", err
-	}
-	if err := w.Close(); err != nil {
-		return "", err
-	}
+// defaultMaxMessagesPerConnection is used if no limit of mails per SMTP session is configured
+const defaultMaxMessagesPerConnection = 50
+
+// Mailer sends mails over one SMTP session that is reused for all mails of a run. The session is opened
+// with the first mail and replaced after MaxMessagesPerConnection mails or if the server closed it.
+// The rate limits of the account are checked against the quota before every mail.
+type Mailer struct {
+	account   SMTPAccount
+	tlsConfig *tls.Config
+	quota     *SendQuota
+	client    *smtp.Client
+	// sent counts the mails of the current session
+	sent int
+}
 
-	return ac.String(), nil
+// NewMailer creates a mailer for the SMTP account, it connects with the first mail
+func NewMailer(account SMTPAccount, tlsConfig *tls.Config, quota *SendQuota) *Mailer {
+	return &Mailer{account: account, tlsConfig: tlsConfig, quota: quota}
 }
 
-// createSubject adds correct line breaks and encodes to quoted printable
-func createSubject(s string) (string, error) {
-	partP, err := toQuotedPrintable(s)
-	if err != nil {
-		return "", err
+// checkQuota returns a *quotaExceededError if the rate limits of the account do not allow n more mails
+func (m *Mailer) checkQuota(n int) error {
+	if m.quota == nil {
+		return nil
 	}
-	lines := strings.Split(partP, "\r\n")
-
-	var out string
-
-	for i, part := range lines {
-		if i > 0 {
-			// seperate every chunk with space
-			out += " "
-		}
-		out += fmt.Sprintf("%s%s%s", "=?UTF-8?Q?", part, "?=")
+	return m.quota.check(m.account, n)
+}
 
-		// last line of the subject has no line break, as this is added to each header later anyway
-		if i < len(lines)-1 {
-			out += "\r\n"
-		}
-	}
-	return out, nil
+// logQuota logs the remaining quota of the account
+func (m *Mailer) logQuota() {
+	logSendQuota(m.quota, m.account)
 }
 
-// SendEmailWithPDFBinaryAttachment sends email with pdf Binary attachment
-func SendEmailWithPDFBinaryAttachment(smtpHost, smtpPort, connectionType, sender, user, password, subject, body, filename string, bCCAddresses, recipients []string, attachment []byte) error {
-	// create quoted printable with correct line breaks for the subject
-	subjectP, err := createSubject(subject)
+// Send sends the message, the sender address is the one of the account, the display name is rendered with the mail. The message is sent to To and Cc,
+// bcc receivers are added to the envelope, but not shown in the header.
+// If the plain body is empty, the plain text part is converted from the html body.
+// A mail larger than the configured maximum size or the SIZE announced by the server fails with a *messageTooLargeError before it is sent.
+func (m *Mailer) Send(msg mailMessage, bcc []mail.Address) error {
+	sender := m.account.SMTPAddress
+	msg.From.Address = sender
+
+	data, err := msg.build()
 	if err != nil {
+		return fmt.Errorf("failed to build mail: %v", err)
+	}
+	if maxSize := m.account.getMaxMessageSize(); maxSize > 0 && len(data) > maxSize {
+		return &messageTooLargeError{Size: len(data), Limit: maxSize}
+	}
+	if err := m.checkQuota(1); err != nil {
 		return err
 	}
 
-	// body to quoted printable
-	bodyP, err := toQuotedPrintable(body)
+	client, err := m.session()
 	if err != nil {
 		return err
 	}
 
-	// create plain text version of the body
-	plain := html2text.HTML2Text(body)
+	// respect the maximum message size of the server, see RFC 1870
+	if ok, param := client.Extension("SIZE"); ok {
+		if limit, err := strconv.Atoi(param); err == nil && limit > 0 && len(data) > limit {
+			return &messageTooLargeError{Size: len(data), Limit: limit}
+		}
+	}
 
-	bodyPlainP, err := toQuotedPrintable(plain)
-	if err != nil {
-		return err
+	// Set the sender and recipient
+	if err := client.Mail(sender); err != nil {
+		return fmt.Errorf("failed to set mail sender: %v", err)
 	}
 
-	// Create the email header
-	header := make(map[string]string)
-	header["From"] = sender
-	header["To"] = strings.Join(recipients, ",")
-	header["Subject"] = subjectP
-	header["MIME-Version"] = "1.0"
-	header["Content-Type"] = `multipart/mixed; boundary="BOUNDARY111"`
-	header["Date"] = time.Now().Format(time.RFC1123Z)
-	header["Message-ID"] = fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), smtpHost)
+	for _, recipient := range msg.To {
+		if err := client.Rcpt(recipient.Address); err != nil {
+			return fmt.Errorf("failed to set mail receiver: %v", err)
+		}
+	}
+	for _, recipient := range msg.Cc {
+		if err := client.Rcpt(recipient.Address); err != nil {
+			return fmt.Errorf("failed to set mail CC receiver: %v", err)
+		}
+	}
+	// bcc receivers are added to the email, but not shown in the header
+	for _, recipient := range bcc {
+		if err := client.Rcpt(recipient.Address); err != nil {
+			return fmt.Errorf("failed to set mail BCC receiver: %v", err)
+		}
+	}
 
-	var emailBuf bytes.Buffer
-	for k, v := range header {
-		emailBuf.WriteString(fmt.Sprintf("%s: %s%s", k, v, "\r\n"))
+	// Get the data writer to send the email body
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to get writer: %v", err)
 	}
 
-	emailBuf.WriteString(fmt.Sprintf(`%s--BOUNDARY111%s`, "\r\n", "\r\n"))
+	// Write the message to the data writer
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("unable to send email: %v", err)
+	}
 
-	// sub boundary
-	emailBuf.WriteString(fmt.Sprintf(`Content-Type: multipart/alternative; boundary="BOUNDARY222"%s`, "\r\n"))
-	emailBuf.WriteString(fmt.Sprintf(`%s--BOUNDARY222%s`, "\r\n", "\r\n"))
+	// the server accepts the mail with the reply to the end of data
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mail was not accepted: %v", err)
+	}
+	m.sent++
 
-	// Create the body part
-	emailBuf.WriteString(fmt.Sprintf(`Content-Type: text/plain; charset=UTF-8%s`, "\r\n"))
-	emailBuf.WriteString(fmt.Sprintf(`Content-Transfer-Encoding: quoted-printable%s`, "\r\n\r\n"))
+	if m.quota != nil {
+		if err := m.quota.record(m.account); err != nil {
+			log.Printf("warning: mail was sent, but could not be recorded in send quota: %v", err)
+		}
+	}
 
-	// write the email body to the buffer
-	// the last part is the most preferred content to render for the email client
-	emailBuf.WriteString(bodyPlainP)
+	return nil
+}
 
-	emailBuf.WriteString(fmt.Sprintf(`%s--BOUNDARY222%s`, "\r\n", "\r\n"))
+// session returns a session that is ready for a new mail. An open session is reset with RSET, which also
+// tells if the server dropped it in the meantime, then a new one is opened.
+func (m *Mailer) session() (*smtp.Client, error) {
+	if m.client != nil && m.sent >= m.account.getMaxMessagesPerConnection() {
+		m.Close()
+	}
 
-	// Create the body html part
-	emailBuf.WriteString(fmt.Sprintf(`Content-Type: text/html; charset=UTF-8%s`, "\r\n"))
-	emailBuf.WriteString(fmt.Sprintf(`Content-Transfer-Encoding: quoted-printable%s`, "\r\n\r\n"))
+	if m.client != nil {
+		if err := m.client.Reset(); err != nil {
+			log.Printf("SMTP session was closed by the server, reconnecting: %v", err)
+			m.client.Close()
+			m.client = nil
+		}
+	}
 
-	// write the email html body to the buffer
-	emailBuf.WriteString(bodyP)
+	if m.client == nil {
+		client, err := dialSMTP(m.account, m.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		m.client, m.sent = client, 0
+	}
+	return m.client, nil
+}
 
-	// close sub boundary
-	emailBuf.WriteString(fmt.Sprintf(`%s--BOUNDARY222--%s`, "\r\n", "\r\n"))
+// Close ends the session with QUIT, the next mail opens a new one
+func (m *Mailer) Close() {
+	if m.client == nil {
+		return
+	}
+	if err := m.client.Quit(); err != nil {
+		m.client.Close()
+	}
+	m.client = nil
+}
 
-	emailBuf.WriteString(fmt.Sprintf(`%s--BOUNDARY111%s`, "\r\n", "\r\n"))
+// mailerSet holds the mailers of the SMTP profiles used in a run, they are created with the first mail of a profile
+type mailerSet struct {
+	quota   *SendQuota
+	mailers map[string]*Mailer
+}
 
-	// Create the attachment part
-	emailBuf.WriteString(fmt.Sprintf(`Content-Type: application/pdf; name="%s"%s`, filename, "\r\n"))
-	emailBuf.WriteString(fmt.Sprintf(`Content-Transfer-Encoding: base64%s`, "\r\n"))
-	emailBuf.WriteString(fmt.Sprintf(`Content-Disposition: attachment; filename="%s"%s`, filename, "\r\n\r\n"))
+// newMailerSet creates an empty mailer set, all mailers share the quota
+func newMailerSet(quota *SendQuota) *mailerSet {
+	return &mailerSet{quota: quota, mailers: make(map[string]*Mailer)}
+}
 
-	b := make([]byte, base64.StdEncoding.EncodedLen(len(attachment)))
-	base64.StdEncoding.Encode(b, attachment)
+// get returns the mailer of the SMTP profile
+func (s *mailerSet) get(profile string) *Mailer {
+	if m, ok := s.mailers[profile]; ok {
+		return m
+	}
+	// the profiles of the rules are validated at startup
+	account, _ := Config.Email.getSMTPProfile(profile)
+	m := NewMailer(account, smtpTLSConfigs[profile], s.quota)
+	s.mailers[profile] = m
+	return m
+}
 
-	if err := addLinesSplittedToBuffer(b, &emailBuf); err != nil {
-		return fmt.Errorf("failed to add line separators to BinaryFile: %v", err)
+// Close ends the sessions of all mailers
+func (s *mailerSet) Close() {
+	for _, m := range s.mailers {
+		m.Close()
 	}
+}
 
-	emailBuf.WriteString(fmt.Sprintf(`%s--BOUNDARY111--`, "\r\n"))
+// logQuota logs the remaining quota of every SMTP profile with rate limits
+func (s *mailerSet) logQuota() {
+	for _, name := range Config.Email.getSMTPProfileNames() {
+		account, _ := Config.Email.getSMTPProfile(name)
+		logSendQuota(s.quota, account)
+	}
+}
+
+// SMTP connection types
+const (
+	// connectionTLS uses implicit TLS, normally on port 465
+	connectionTLS = "tls"
+	// connectionSTARTTLS upgrades the connection with STARTTLS and fails if the server does not offer it, normally on port 587
+	connectionSTARTTLS = "starttls"
+	// connectionPlain upgrades the connection with STARTTLS if the server offers it and stays unencrypted otherwise
+	connectionPlain = "plain"
+	// connectionNone never encrypts the connection, e.g. for a relay on localhost
+	connectionNone = "none"
+)
 
-	addr := fmt.Sprintf("%s:%s", smtpHost, smtpPort)
-	auth := smtp.PlainAuth("", user, password, smtpHost)
+// dialSMTP connects to the SMTP server of the account and logs in if credentials are configured
+func dialSMTP(account SMTPAccount, tlsConfig *tls.Config) (*smtp.Client, error) {
+	smtpHost := account.SMTPServer
+	addr := fmt.Sprintf("%s:%s", smtpHost, account.SMTPPort)
 
 	var client *smtp.Client
 
-	if connectionType == "tls" {
-
+	switch account.SMTPConnectionType {
+	case connectionTLS:
 		// Create an SSL/TLS connection
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         smtpHost,
-		}
-
-		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		conn, err := tls.Dial("tcp", addr, forServer(tlsConfig, smtpHost))
 		if err != nil {
 			if err.Error() == "tls: first record does not look like a TLS handshake" {
-				return fmt.Errorf("failed to dial TLS: %v - Try to change smtpConnectionType Config", err)
+				return nil, fmt.Errorf("failed to dial TLS: %v - Try to change smtpConnectionType Config", err)
 			}
-			return fmt.Errorf("failed to dial TLS: %v", err)
+			return nil, fmt.Errorf("failed to dial TLS: %v", err)
 		}
 
 		// Create new client using the SSL connection
 		client, err = smtp.NewClient(conn, smtpHost)
 		if err != nil {
-			return fmt.Errorf("failed to create SMTP client: %v", err)
-		}
-		defer client.Close()
-
-		// Authenticate
-		if err = client.Auth(auth); err != nil {
-			return fmt.Errorf("failed to authenticate: %v", err)
+			conn.Close()
+			return nil, fmt.Errorf("failed to create SMTP client: %v", err)
 		}
 
-	} else if connectionType == "starttls" {
-		// Handle TLS/STARTTLS (port 587)
+	case connectionSTARTTLS, connectionPlain, connectionNone:
+		var err error
 		client, err = smtp.Dial(addr)
 		if err != nil {
 			if err.Error() == "EOF" {
-				return fmt.Errorf("failed to dial: %v - Try to change smtpConnectionType Config", err)
+				return nil, fmt.Errorf("failed to dial: %v - Try to change smtpConnectionType Config", err)
 			}
-			return fmt.Errorf("failed to dial: %v", err)
+			return nil, fmt.Errorf("failed to dial: %v", err)
 		}
-		defer client.Close()
-
-		// TLS
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         smtpHost,
-		}
-		if err = client.StartTLS(tlsConfig); err != nil {
-			return fmt.Errorf("failed to start TLS: %v", err)
-		}
-
-		// Authenticate
-		if err = client.Auth(auth); err != nil {
-			return fmt.Errorf("failed toauthenticate: %v", err)
-		}
-	} else {
-		return fmt.Errorf("given SMTP connection Type invalid")
-	}
-
-	// Set the sender and recipient
-	if err := client.Mail(sender); err != nil {
-		return fmt.Errorf("failed to set mail sender: %v", err)
-	}
 
-	for _, recipient := range recipients {
-		if err := client.Rcpt(recipient); err != nil {
-			return fmt.Errorf("failed to set mail receiver: %v", err)
-		}
-	}
-	// bcc receivers are added to the email, but not shown in the header
-	for _, recipient := range bCCAddresses {
-		if err := client.Rcpt(recipient); err != nil {
-			return fmt.Errorf("failed to set mail BCC receiver: %v", err)
+		switch account.SMTPConnectionType {
+		case connectionSTARTTLS:
+			if err = client.StartTLS(forServer(tlsConfig, smtpHost)); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("failed to start TLS: %v", err)
+			}
+		case connectionPlain:
+			if ok, _ := client.Extension("STARTTLS"); ok {
+				// opportunistic TLS only protects against passive eavesdropping, like between MTAs the certificate
+				// is not verified, so internal relays with self-signed certificates work. See RFC 7435.
+				// A configured CA or server name asks for verification, loadTLSConfigs warns if it is missing.
+				opportunistic := forServer(tlsConfig, smtpHost)
+				if !account.TLS.verifiesServer() {
+					opportunistic.InsecureSkipVerify = true
+				}
+				if err = client.StartTLS(opportunistic); err != nil {
+					client.Close()
+					if account.TLS.verifiesServer() {
+						return nil, fmt.Errorf("failed to start opportunistic TLS: %v", err)
+					}
+					return nil, fmt.Errorf("failed to start opportunistic TLS: %v - Try smtpConnectionType none", err)
+				}
+			}
 		}
-	}
-
-	// Get the data writer to send the email body
-	w, err := client.Data()
-	if err != nil {
-		return fmt.Errorf("failed to get writer: %v", err)
-	}
-	defer w.Close()
 
-	// Write the message to the data writer
-	_, err = w.Write(emailBuf.Bytes())
-	if err != nil {
-		return fmt.Errorf("unable to send email: %v", err)
+	default:
+		return nil, fmt.Errorf("given SMTP connection Type invalid")
 	}
 
-	client.Quit()
-
-	return nil
-}
-
-func addLinesSplittedToBuffer(b []byte, emailBuf *bytes.Buffer) error {
-	// limit the lines to up to 76 chars
-	for i, l := 0, len(b); i < l; i++ {
-		if err := emailBuf.WriteByte(b[i]); err != nil {
-			return err
-		}
-		if (i+1)%76 == 0 {
-			if _, err := emailBuf.WriteString("\r\n"); err != nil {
-				return err
-			}
-
+	// relays that accept mails without login need no credentials
+	if account.hasCredentials() {
+		if err := authenticate(client, account); err != nil {
+			client.Close()
+			return nil, err
 		}
 	}
-	return nil
+	return client, nil
 }
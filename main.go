@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
-	"strconv"
 	"strings"
 	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
 )
 
 func main() {
@@ -17,8 +20,23 @@ func main() {
 	// if runEveryXMinute is set, a ticker executes the logic over and over again, otherwise the logic is executed once
 	rand.Seed(time.Now().UnixNano())
 
-	if err := processJob(); err != nil {
-		log.Fatalf("error Process Job: %v", err)
+	client := newPaperlessClientFromConfig()
+
+	ledger, err := OpenSendLedger(Config.getLedgerPath())
+	if err != nil {
+		log.Fatalf("error opening send ledger: %v", err)
+	}
+
+	quota, err := OpenSendQuota(Config.getSendQuotaPath())
+	if err != nil {
+		log.Fatalf("error opening send quota: %v", err)
+	}
+
+	if err := processJob(context.Background(), client, ledger, quota); err != nil {
+		if Config.RunEveryXMinute == -1 {
+			log.Fatalf("error Process Job: %v", err)
+		}
+		log.Printf("error Process Job: %v", err)
 	}
 
 	if Config.RunEveryXMinute == -1 {
@@ -28,240 +46,449 @@ func main() {
 	ticker := time.NewTicker(time.Duration(Config.RunEveryXMinute) * time.Minute)
 	defer ticker.Stop()
 
+	// a failed run, e.g. while paperless is restarting, is logged and retried with the next tick
 	for range ticker.C {
-		if err := processJob(); err != nil {
-			log.Fatalf("error Process Job: %v", err)
+		if err := processJob(context.Background(), client, ledger, quota); err != nil {
+			log.Printf("error Process Job: %v", err)
 		}
 	}
 }
 
-func processJob() error {
-	tags, err := getTags()
+// processJob fetches all queued documents and sends them according to the rules.
+// Every rule has a processed tag, either its own or the global one. A rule is pending for a document
+// as long as the document misses its processed tag. The tag is added once all matching rules that share
+// it were sent successfully. Sent mails are recorded in the ledger, so a failing rule or tag update never
+// leads to a mail being sent twice.
+func processJob(ctx context.Context, client paperless.Client, ledger *SendLedger, quota *SendQuota) error {
+	tags, err := client.GetTags(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting tags: %v", err)
 	}
 
-	correspondents, err := getCorrespondents()
+	correspondents, err := client.GetCorrespondents(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting correspondents: %v", err)
 	}
 
-	documentTypes, err := getDocumentTypes()
+	documentTypes, err := client.GetDocumentTypes(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting document types: %v", err)
 	}
 
-	storagePaths, err := getStoragePaths()
+	storagePaths, err := client.GetStoragePaths(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting storage pathes: %v", err)
 	}
 
-	users, err := getUsers()
+	users, err := client.GetUsers(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting users: %v", err)
 	}
 
-	processedTag := getTagByName(tags, Config.Paperless.ProcessedTagName)
-	if processedTag == nil {
-		return fmt.Errorf("error finding processedTagName:%s in list from server", Config.Paperless.ProcessedTagName)
+	// custom fields are not available in older paperless versions, rules using them won't match
+	customFields, err := client.GetCustomFields(ctx)
+	if err != nil {
+		log.Printf("warning: error getting custom fields, conditions on custom fields won't match: %v", err)
 	}
 
-	searchTag := getTagByName(tags, Config.Paperless.AddQueueTagName)
-	if searchTag == nil {
-		return fmt.Errorf("error finding searchTagName:%s in list from from server", Config.Paperless.AddQueueTagName)
+	// queue and processed tag of each rule, same order as Config.Paperless.Rules
+	var ruleQueueTags, ruleProcessedTags []paperless.Tag
+	for _, rule := range Config.Paperless.Rules {
+		queueTag := paperless.TagByName(tags, rule.getQueueTagName())
+		if queueTag == nil {
+			return fmt.Errorf("error finding addQueueTagName:%s of rule %s in list from server", rule.getQueueTagName(), rule.Name)
+		}
+		ruleQueueTags = append(ruleQueueTags, *queueTag)
+
+		processedTag := paperless.TagByName(tags, rule.getProcessedTagName())
+		if processedTag == nil {
+			return fmt.Errorf("error finding processedTagName:%s of rule %s in list from server", rule.getProcessedTagName(), rule.Name)
+		}
+		ruleProcessedTags = append(ruleProcessedTags, *processedTag)
 	}
 
-	documents, err := getDocumentsByTag(*searchTag, *processedTag)
+	documents, err := client.GetDocumentsByTags(ctx, buildDocumentQueries(ruleQueueTags, ruleProcessedTags))
 	if err != nil {
 		return fmt.Errorf("error getting documents with tag: %v", err)
 	}
 
 	if len(documents) == 0 {
 		log.Println("no documents found to process")
+		// the remaining quota is logged on every run
+		newMailerSet(quota).logQuota()
 		return nil
 	}
 
-	for _, doc := range documents {
-		// check if rule for document exists, and process doc
-		// all tags of a rule need to be available for the doc
-		atLeastOneRuleMatches := false
+	// processed tag groups of every document, they are tagged once all digests of the run were sent
+	var processed []processedDocument
+	// documents collected by digest rules, same order as Config.Paperless.Rules
+	var digests []*digestBatch
 
-		for _, rule := range Config.Paperless.Rules {
-			docMatchesRuleTag, docMatchesRuleCorrespondent, docMatchesRuleType := false, false, false
-			for _, ruleTag := range rule.Tags {
-				foundDocTag := false
-				for _, id := range doc.TagIDs {
-					found := getTagByID(tags, id)
-					if found == nil {
-						return fmt.Errorf("Tag %d is not available in tags list", id)
-					}
-
-					if ruleTag == found.Name {
-						foundDocTag = true
-					}
-				}
+	// all mails of the run share one SMTP session per profile
+	mailers := newMailerSet(quota)
+	defer mailers.Close()
 
-				if foundDocTag {
-					docMatchesRuleTag = true
-				} else {
-					docMatchesRuleTag = false
-					break
-				}
-
-				// check if correspondents are matching
-				// if correspondent is set in rule, but does not match skip the doc for that rule
-				// if correspondent is not set in rule, proceed
-				docCorrespondent := getCorrespondentByID(correspondents, doc.CorrespondentId)
-				if docCorrespondent != nil && rule.Correspondent == docCorrespondent.Name {
-					docMatchesRuleCorrespondent = true
-				} else if rule.Correspondent == "" {
-					docMatchesRuleCorrespondent = true
-				} else {
-					docMatchesRuleCorrespondent = false
-				}
+	for idx := range documents {
+		doc := &documents[idx]
+		data, err := newDocumentData(doc, tags, correspondents, documentTypes, storagePaths, users, customFields)
+		if err != nil {
+			return err
+		}
 
-				// check if types are matching
-				// if type is set in rule, but does not match skip the doc for that rule
-				// if type is not set in rule, proceed
-				docType := getDocumentTypeByID(documentTypes, doc.DocumentTypeId)
-				if docType != nil && rule.Type == docType.Name {
-					docMatchesRuleType = true
-				} else if rule.Type == "" {
-					docMatchesRuleType = true
-				} else {
-					docMatchesRuleType = false
-				}
+		// check if rule for document exists, and process doc
+		atLeastOneRuleMatches := false
+		// pending rules grouped by their processed tag
+		var groups []*processedTagGroup
 
+		for ruleIdx, rule := range Config.Paperless.Rules {
+			// the document is not queued for that rule
+			if !doc.HasTag(ruleQueueTags[ruleIdx].ID) {
+				continue
 			}
-			// tags and correspondent + type (if set) need to match
-			if !(docMatchesRuleTag && docMatchesRuleCorrespondent && docMatchesRuleType) {
+
+			// tags, correspondent, type and condition of the rule need to match
+			if !rule.getCondition().matches(data) {
 				// if the rule does not match, try next rule
 				continue
 			}
+			atLeastOneRuleMatches = true
+
+			// the document was already processed by that rule
+			processedTag := ruleProcessedTags[ruleIdx]
+			if doc.HasTag(processedTag.ID) {
+				continue
+			}
+			group := getProcessedTagGroup(&groups, processedTag)
+
 			// found a rule that matches, start processing
-			log.Printf("found Rule: %s, that matches Tag(s) (%s) in document: '%s' (%d)", rule.Name, strings.Join(rule.Tags, ","), doc.getFileName(), doc.ID)
+			log.Printf("found Rule: %s, that matches %s in document: '%s' (%d)", rule.Name, rule.getCondition(), getFileName(doc), doc.ID)
+			group.rules = append(group.rules, rule.Name)
+
+			// the time the document was collected first by a digest rule with a window
+			var pendingSince time.Time
+			if entry, ok := ledger.Get(*doc, rule.Name); ok {
+				switch entry.State {
+				case ledgerStateSent:
+					log.Printf("document '%s' (%d) was already sent by rule %s at %s, skipping", getFileName(doc), doc.ID, rule.Name, entry.UpdatedAt.Format(time.RFC3339))
+					continue
+				case ledgerStatePending:
+					pendingSince = entry.UpdatedAt
+				default:
+					// the service stopped while sending, the mail might be delivered or not
+					log.Printf("warning: sending document '%s' (%d) by rule %s was interrupted at %s, it is not sent again to avoid duplicates. Check the receivers and remove the entry from the send ledger to send it again",
+						getFileName(doc), doc.ID, rule.Name, entry.UpdatedAt.Format(time.RFC3339))
+					group.failed = true
+					continue
+				}
+			}
+
+			if data.Owner == nil {
+				log.Printf("warning: could not find user for doc with id=%d, placeholders will be empty", doc.ID)
+			}
 
-			user := getUserByID(users, doc.OwnerId)
-			if user == nil {
-				log.Printf("warning: could not find user for doc with id=%d, placeholders won't work", doc.ID)
+			if data.Correspondent == nil {
+				log.Printf("warning: could not find a correspondent for doc with id=%d, placeholders will be empty", doc.ID)
 			}
 
-			correspondent := getCorrespondentByID(correspondents, doc.CorrespondentId)
-			if correspondent == nil {
-				log.Printf("warning: could not find a correspondent for doc with id=%d, placeholders won't work", doc.ID)
+			if data.DocumentType == nil {
+				log.Printf("warning: could not find a document type for doc with id=%d, placeholders will be empty", doc.ID)
 			}
 
-			documentType := getDocumentTypeByID(documentTypes, doc.DocumentTypeId)
-			if documentType == nil {
-				log.Printf("warning: could not find a document type for doc with id=%d, placeholders won't work", doc.ID)
+			if data.StoragePath == nil {
+				log.Printf("warning: could not find a storage path for doc with id=%d, placeholders will be empty", doc.ID)
 			}
 
-			storagePath := getStoragePathByID(storagePaths, doc.StoragePath)
-			if storagePath == nil {
-				log.Printf("warning: could not find a storage path for doc with id=%d, placeholders won't work", doc.ID)
+			// digests are sent after all documents were collected
+			if rule.Digest {
+				batch := getDigestBatch(&digests, rule)
+				batch.items = append(batch.items, digestItem{doc: doc, data: data, group: group, since: pendingSince})
+				continue
 			}
 
-			mailHeader := prepareMail(Config.Email.MailHeader, rule.MailHeader, user, correspondent, documentType, storagePath, &doc)
-			mailBody := prepareMail(Config.Email.MailBody, rule.MailBody, user, correspondent, documentType, storagePath, &doc)
+			// documents over the send quota are not downloaded, they are sent by a later run
+			mailer := mailers.get(rule.getSMTPProfile())
+			if err := mailer.checkQuota(1); err != nil {
+				log.Printf("document '%s' (%d) is deferred for rule %s: %v", getFileName(doc), doc.ID, rule.Name, err)
+				group.deferred = true
+				continue
+			}
 
-			if err := SendProcessDoc(doc, processedTag, mailHeader, mailBody, rule.BCCAddresses, rule.ReceiverAddresses); err != nil {
+			if err := SendProcessDoc(ctx, client, ledger, mailer, doc, rule, newTemplateData(data, rule, time.Now()), customFields); err != nil {
+				var exceeded *quotaExceededError
+				if errors.As(err, &exceeded) {
+					log.Printf("document '%s' (%d) is deferred for rule %s: %v", getFileName(doc), doc.ID, rule.Name, err)
+					group.deferred = true
+					continue
+				}
 				log.Printf("error processing Doc: %v", err)
+				group.failed = true
 				continue
 			}
-			if len(rule.BCCAddresses) > 0 {
-				log.Printf("document '%s' (%d) successfully sent to '%s' and BCC to '%s'",
-					doc.getFileName(), doc.ID,
-					strings.Join(rule.ReceiverAddresses, ","),
-					strings.Join(rule.BCCAddresses, ","))
-			} else {
-				log.Printf("document '%s' (%d) successfully sent to '%s'",
-					doc.getFileName(), doc.ID,
-					strings.Join(rule.ReceiverAddresses, ","))
-			}
-			atLeastOneRuleMatches = true
-			//goto nextDoc
+			// custom fields may have changed by the update after sending
+			data.CustomFields = newCustomFieldValues(doc.CustomFields, customFields)
 		}
 		if !atLeastOneRuleMatches {
-			log.Printf("document '%s' (%d) marked for processing, but no Ruleset matches the tags ...", doc.getFileName(), doc.ID)
+			log.Printf("document '%s' (%d) marked for processing, but no Ruleset matches the tags ...", getFileName(doc), doc.ID)
+			continue
+		}
+		processed = append(processed, processedDocument{doc: doc, groups: groups})
+	}
+
+	for _, batch := range digests {
+		sendDigest(ctx, client, ledger, mailers.get(batch.rule.getSMTPProfile()), batch, customFields)
+	}
+	mailers.Close()
+	mailers.logQuota()
+
+	for _, p := range processed {
+		doc := p.doc
+		for _, group := range p.groups {
+			if group.deferred {
+				continue
+			}
+			if group.failed {
+				log.Printf("document '%s' (%d) was not sent by all rules with processed tag %s, it stays in the queue", getFileName(doc), doc.ID, group.tag.Name)
+				continue
+			}
+
+			if err := client.AddTagToDocument(ctx, *doc, group.tag); err != nil {
+				log.Printf("could not add Tag %s for document '%s' (%d), the send ledger prevents sending it again: %v", group.tag.Name, getFileName(doc), doc.ID, err)
+				continue
+			}
+
+			// the processed tag is set, from now on paperless knows the document was sent by these rules
+			for _, ruleName := range group.rules {
+				if err := ledger.Remove(*doc, ruleName); err != nil {
+					log.Printf("error cleaning up send ledger: %v", err)
+				}
+			}
 		}
-		//nextDoc:
 	}
 
 	return nil
 }
 
-func prepareMail(str, ruleStr string, user *User, correspondent *Correspondent, documenType *DocumentType, storagePath *StoragePath, document *Document) string {
-	// use the header,body string from rule if set
-	if ruleStr != "" {
-		str = ruleStr
-	}
+// buildDocumentQueries creates one query per processed tag. It selects the documents holding the queue tag of
+// any rule with that processed tag, but not the processed tag itself.
+func buildDocumentQueries(ruleQueueTags, ruleProcessedTags []paperless.Tag) []paperless.DocumentQuery {
+	var queries []paperless.DocumentQuery
+
+	for idx, processedTag := range ruleProcessedTags {
+		var query *paperless.DocumentQuery
+		for q := range queries {
+			if queries[q].ExcludedTags[0].ID == processedTag.ID {
+				query = &queries[q]
+				break
+			}
+		}
+		if query == nil {
+			queries = append(queries, paperless.DocumentQuery{ExcludedTags: []paperless.Tag{processedTag}})
+			query = &queries[len(queries)-1]
+		}
 
-	if user != nil {
-		str = strings.ReplaceAll(str, "%user_name%", user.Username)
-		str = strings.ReplaceAll(str, "%user_id%", strconv.Itoa(user.ID))
-		str = strings.ReplaceAll(str, "%user_email%", user.Email)
-		str = strings.ReplaceAll(str, "%first_name%", user.FirstName)
-		str = strings.ReplaceAll(str, "%last_name%", user.LastName)
+		if paperless.TagByID(query.AnyTags, ruleQueueTags[idx].ID) == nil {
+			query.AnyTags = append(query.AnyTags, ruleQueueTags[idx])
+		}
 	}
+	return queries
+}
+
+// processedTagGroup collects the pending rules of a document that share the same processed tag
+type processedTagGroup struct {
+	tag    paperless.Tag
+	rules  []string
+	failed bool
+	// deferred is set if a digest rule of the group waits for its window or the send quota is used up, the document stays in the queue
+	deferred bool
+}
 
-	if correspondent != nil {
-		str = strings.ReplaceAll(str, "%correspondent_name%", correspondent.Name)
-		str = strings.ReplaceAll(str, "%correspondent_id%", strconv.Itoa(correspondent.ID))
+// processedDocument holds the processed tag groups of a document until they are tagged
+type processedDocument struct {
+	doc    *paperless.Document
+	groups []*processedTagGroup
+}
 
+// getProcessedTagGroup returns the group of the tag and adds it to groups if it does not exist yet
+func getProcessedTagGroup(groups *[]*processedTagGroup, tag paperless.Tag) *processedTagGroup {
+	for _, group := range *groups {
+		if group.tag.ID == tag.ID {
+			return group
+		}
 	}
+	group := &processedTagGroup{tag: tag}
+	*groups = append(*groups, group)
+	return group
+}
+
+// SendProcessDoc sends the document by mail, either with the files the attachment policy of the rule asks for or with a share link.
+// The delivery is recorded in the ledger. After sending, the custom fields of the document are updated.
+func SendProcessDoc(ctx context.Context, client paperless.Client, ledger *SendLedger, mailer *Mailer, doc *paperless.Document, r rule, templateData TemplateData, customFields []paperless.CustomField) error {
+	var attachments []mailAttachment
+	var shareLink *paperless.ShareLink
+
+	// the share link of a mail that was not sent is revoked
+	sent := false
+	defer func() {
+		if shareLink != nil && !sent {
+			revokeShareLink(ctx, client, *shareLink)
+		}
+	}()
 
-	if documenType != nil {
-		str = strings.ReplaceAll(str, "%document_type_name%", documenType.Name)
-		str = strings.ReplaceAll(str, "%document_type_id%", strconv.Itoa(documenType.ID))
+	if r.getDelivery() == deliveryLink {
+		link, err := createShareLink(ctx, client, doc, r)
+		if err != nil {
+			return err
+		}
+		shareLink = &link
+		templateData.ShareLink = newTemplateShareLink(link)
+	} else {
+		// download document
+		var err error
+		attachments, err = downloadAttachments(ctx, client, doc, r.getAttachmentPolicy())
+		if err != nil {
+			return fmt.Errorf("failed to download document: '%s' (%d): %v", getFileName(doc), doc.ID, err)
+		}
 
+		for _, attachment := range attachments {
+			log.Printf("downloaded document: '%s' (%d) as %s (%s)", getFileName(doc), doc.ID, attachment.Filename, attachment.ContentType)
+		}
 	}
 
-	if storagePath != nil {
-		str = strings.ReplaceAll(str, "%storage_path_name%", storagePath.Name)
-		str = strings.ReplaceAll(str, "%storage_path_id%", strconv.Itoa(storagePath.ID))
-		str = strings.ReplaceAll(str, "%storage_path%", storagePath.Path)
+	mail, fieldUpdates, err := renderDocumentMail(r, templateData, customFields)
+	if err != nil {
+		return fmt.Errorf("failed to render mail of document '%s' (%d): %v", getFileName(doc), doc.ID, err)
 	}
 
-	str = strings.ReplaceAll(str, "%document_id%", strconv.Itoa(document.ID))
-	str = strings.ReplaceAll(str, "%document_url%", document.getDocumentURL())
-	str = strings.ReplaceAll(str, "%document_title%", document.Title)
-	str = strings.ReplaceAll(str, "%document_file_name%", document.getFileName())
-	str = strings.ReplaceAll(str, "%document_created_at%", document.CreatedAt)
-	str = strings.ReplaceAll(str, "%document_modified_at%", document.ModifiedAt)
+	if err := ledger.MarkSending(*doc, r.Name); err != nil {
+		return fmt.Errorf("could not record document '%s' (%d) in send ledger: %v", getFileName(doc), doc.ID, err)
+	}
 
-	return str
-}
+	// found right rule, send it
+	err = sendMail(mailer, mail, attachments)
+
+	var tooLarge *messageTooLargeError
+	if errors.As(err, &tooLarge) {
+		log.Printf("document '%s' (%d): %v, sending it with oversize policy %s", getFileName(doc), doc.ID, err, r.getOversizePolicy())
+
+		var sentParts int
+		sentParts, err = sendOversizeDocument(mailer, doc, r, mail, attachments, tooLarge)
+		if err != nil && sentParts > 0 {
+			// some parts are delivered, sending all of them again would duplicate them
+			sent = true
+			return fmt.Errorf("error sending email: %v, %d part(s) of document '%s' (%d) were sent already, it is not sent again to avoid duplicates", err, sentParts, getFileName(doc), doc.ID)
+		}
+	}
 
-func SendProcessDoc(doc Document, processedTag *Tag, mailHeader, mailBody string, BCCAddresses, ReceiverAddresses []string) error {
-	// download document
-	bytes, err := downloadDocumentBinary(doc)
 	if err != nil {
-		return fmt.Errorf("failed to download document: '%s' (%d): %v", doc.getFileName(), doc.ID, err)
+		// the mail was not accepted, so it can be sent again with the next run
+		if err := ledger.Remove(*doc, r.Name); err != nil {
+			log.Printf("error cleaning up send ledger: %v", err)
+		}
+		// the caller defers the document
+		var exceeded *quotaExceededError
+		if errors.As(err, &exceeded) {
+			return exceeded
+		}
+		return fmt.Errorf("error sending email: %v", err)
 	}
+	sent = true
 
-	log.Printf("downloaded document: '%s' (%d)", doc.getFileName(), doc.ID)
+	if shareLink != nil {
+		if err := recordShareLink(*shareLink, r.Name); err != nil {
+			log.Printf("warning: share link %d of document '%s' (%d) was sent, but could not be recorded: %v", shareLink.ID, getFileName(doc), doc.ID, err)
+		}
+	}
 
-	// found right rule, send it
-	err = SendEmailWithPDFBinaryAttachment(Config.Email.SMTPServer,
-		Config.Email.SMTPPort,
-		Config.Email.SMTPConnectionType,
-		Config.Email.SMTPAddress,
-		Config.Email.SMTPUser,
-		Config.Email.SMTPPassword,
-		mailHeader,
-		mailBody,
-		doc.getFileName(),
-		BCCAddresses,
-		ReceiverAddresses,
-		bytes)
+	log.Printf("document '%s' (%d) successfully sent to %s", getFileName(doc), doc.ID, formatReceivers(mail))
+
+	if err := ledger.MarkSent(*doc, r.Name); err != nil {
+		return fmt.Errorf("document '%s' (%d) was sent, but could not be recorded in send ledger: %v", getFileName(doc), doc.ID, err)
+	}
+
+	// the mail is sent, a failing update is only logged
+	if len(fieldUpdates) > 0 {
+		customFields, err := client.UpdateCustomFields(ctx, *doc, fieldUpdates)
+		if err != nil {
+			log.Printf("warning: could not update custom fields of document '%s' (%d): %v", getFileName(doc), doc.ID, err)
+		} else {
+			doc.CustomFields = customFields
+		}
+	}
+	return nil
+}
 
+// renderDocumentMail renders the mail and the custom field updates of the rule for a single document
+func renderDocumentMail(r rule, templateData TemplateData, customFields []paperless.CustomField) (renderedMail, []paperless.CustomFieldInstance, error) {
+	mail, err := renderMail(r, templateData)
 	if err != nil {
-		return fmt.Errorf("error sending email: %v", err)
+		return mail, nil, err
 	}
 
-	err = addTagToDocument(doc, *processedTag)
+	fieldValues, err := renderCustomFieldValues(r, templateData.withReceivers(mail))
 	if err != nil {
-		return fmt.Errorf("could not add Tag for document '%s' (%d): %v", doc.getFileName(), doc.ID, err)
+		return mail, nil, err
 	}
-	return nil
+	return mail, prepareCustomFieldUpdates(r.getCustomFieldUpdates(), fieldValues, customFields, r.Name), nil
+}
+
+// sendOversizeDocument sends a mail that exceeded the maximum message size according to the oversize policy of the rule.
+// It returns the number of parts that were sent, so a failing split can be told apart from a mail that was not sent at all.
+func sendOversizeDocument(mailer *Mailer, doc *paperless.Document, r rule, mail renderedMail, attachments []mailAttachment, tooLarge *messageTooLargeError) (int, error) {
+	switch r.getOversizePolicy() {
+	case oversizeLink:
+		if err := sendMail(mailer, withDocumentLinks(mail, []*paperless.Document{doc}), nil); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	case oversizeSplit:
+		// every file is a unit of its own, a single file can't be split
+		units := make([][]mailAttachment, 0, len(attachments))
+		for _, attachment := range attachments {
+			units = append(units, []mailAttachment{attachment})
+		}
+		parts, oversized := packParts(units, estimatedBaseSize(mail), tooLarge.Limit)
+		if len(oversized) > 0 {
+			return 0, fmt.Errorf("%s of %s can't be split: %v", attachments[oversized[0]].Filename, formatSize(len(attachments[oversized[0]].Data)), tooLarge)
+		}
+		// all parts must fit into the quota, a document that is sent partially is not sent again
+		if err := mailer.checkQuota(len(parts)); err != nil {
+			return 0, err
+		}
+
+		for idx, part := range parts {
+			var partAttachments []mailAttachment
+			for _, unit := range part {
+				partAttachments = append(partAttachments, attachments[unit])
+			}
+			if err := sendMail(mailer, withPartHeader(mail, idx+1, len(parts)), partAttachments); err != nil {
+				return idx, fmt.Errorf("part %d of %d: %v", idx+1, len(parts), err)
+			}
+		}
+		return len(parts), nil
+	}
+	return 0, tooLarge
+}
+
+// formatReceivers formats the receivers of the mail for logging
+func formatReceivers(mail renderedMail) string {
+	receivers := "'" + strings.Join(append(addressesOf(mail.To), addressesOf(mail.CC)...), ",") + "'"
+	if len(mail.BCC) > 0 {
+		receivers += " and BCC to '" + strings.Join(addressesOf(mail.BCC), ",") + "'"
+	}
+	return receivers
+}
+
+// sendMail sends the rendered mail with the attachments to its receivers using the mailer
+func sendMail(mailer *Mailer, mail renderedMail, attachments []mailAttachment) error {
+	return mailer.Send(mailMessage{
+		From:        newMailAddress(mail.FromName, ""),
+		To:          mail.To,
+		Cc:          mail.CC,
+		ReplyTo:     mail.ReplyTo,
+		Subject:     mail.Header,
+		HTMLBody:    mail.Body,
+		PlainBody:   mail.PlainBody,
+		Attachments: attachments,
+		Headers:     mail.Headers,
+	}, mail.BCC)
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/k3a/html2text"
+)
+
+// mailAttachment is a file attached to a mail
+type mailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// mailMessage is a mail with a html and a plain text body and any number of attachments
+type mailMessage struct {
+	From    mail.Address
+	To      []mail.Address
+	Cc      []mail.Address
+	ReplyTo []mail.Address
+	Subject string
+	// HTMLBody is the preferred body, PlainBody is converted from it if empty
+	HTMLBody    string
+	PlainBody   string
+	Attachments []mailAttachment
+	// Date and MessageID are generated if empty
+	Date      time.Time
+	MessageID string
+	// Headers are additional header fields, their values are encoded like the subject
+	Headers []mailHeader
+	// newBoundary returns the boundary of every multipart body, the boundaries are random if it is nil
+	newBoundary func() string
+}
+
+// mailHeader is a single header field, headers are kept in a slice to write them in a stable order
+type mailHeader struct {
+	Name  string
+	Value string
+}
+
+// maxLineLength is the line length base64 encoded attachments are wrapped at, see RFC 2045
+const maxLineLength = 76
+
+// build creates the RFC 5322 message. The body is a multipart/alternative of the plain text and html part,
+// wrapped into a multipart/mixed together with the attachments if there are any.
+func (m mailMessage) build() ([]byte, error) {
+	alternative, alternativeType, err := m.buildAlternative()
+	if err != nil {
+		return nil, err
+	}
+
+	body := alternative
+	contentType := alternativeType
+
+	if len(m.Attachments) > 0 {
+		var mixed bytes.Buffer
+		w, err := m.multipartWriter(&mixed)
+		if err != nil {
+			return nil, err
+		}
+
+		part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {alternativeType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(alternative); err != nil {
+			return nil, err
+		}
+
+		for _, attachment := range m.Attachments {
+			if err := writeAttachmentPart(w, attachment); err != nil {
+				return nil, fmt.Errorf("failed to add attachment %s: %v", attachment.Filename, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		body = mixed.Bytes()
+		contentType = mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()})
+	}
+
+	headers, err := m.headers(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	for _, h := range headers {
+		msg.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body)
+	return msg.Bytes(), nil
+}
+
+// headers returns the header fields of the message in the order they are written
+func (m mailMessage) headers(contentType string) ([]mailHeader, error) {
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	messageID := m.MessageID
+	if messageID == "" {
+		var err error
+		if messageID, err = newMessageID(m.From.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	headers := []mailHeader{
+		{"Date", date.Format(time.RFC1123Z)},
+		{"From", m.From.String()},
+		{"To", formatAddressList(m.To)},
+	}
+	if len(m.Cc) > 0 {
+		headers = append(headers, mailHeader{"Cc", formatAddressList(m.Cc)})
+	}
+	if len(m.ReplyTo) > 0 {
+		headers = append(headers, mailHeader{"Reply-To", formatAddressList(m.ReplyTo)})
+	}
+	headers = append(headers,
+		mailHeader{"Subject", encodeHeaderValue(m.Subject)},
+		mailHeader{"Message-ID", messageID},
+	)
+	for _, h := range m.Headers {
+		headers = append(headers, mailHeader{h.Name, encodeHeaderValue(h.Value)})
+	}
+	return append(headers,
+		mailHeader{"MIME-Version", "1.0"},
+		mailHeader{"Content-Type", contentType},
+	), nil
+}
+
+// buildAlternative creates the multipart/alternative body, the html part comes last as the most preferred one
+func (m mailMessage) buildAlternative() ([]byte, string, error) {
+	plainBody := m.PlainBody
+	if plainBody == "" {
+		plainBody = html2text.HTML2Text(m.HTMLBody)
+	}
+
+	var b bytes.Buffer
+	w, err := m.multipartWriter(&b)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := writeTextPart(w, "text/plain", plainBody); err != nil {
+		return nil, "", fmt.Errorf("failed to add plain text body: %v", err)
+	}
+	if err := writeTextPart(w, "text/html", m.HTMLBody); err != nil {
+		return nil, "", fmt.Errorf("failed to add html body: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return b.Bytes(), mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": w.Boundary()}), nil
+}
+
+// multipartWriter creates a multipart writer with the boundary of newBoundary, or a random one
+func (m mailMessage) multipartWriter(b *bytes.Buffer) (*multipart.Writer, error) {
+	w := multipart.NewWriter(b)
+	if m.newBoundary != nil {
+		if err := w.SetBoundary(m.newBoundary()); err != nil {
+			return nil, fmt.Errorf("invalid boundary: %v", err)
+		}
+	}
+	return w, nil
+}
+
+// writeTextPart adds a quoted-printable encoded UTF-8 text part
+func writeTextPart(w *multipart.Writer, contentType, text string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"})},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeAttachmentPart adds a base64 encoded attachment part. The filename is set RFC 2231 encoded
+// in Content-Disposition and RFC 2047 encoded in the name parameter of Content-Type for older clients.
+func writeAttachmentPart(w *multipart.Writer, attachment mailAttachment) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	typ := mime.FormatMediaType(contentType, map[string]string{"name": mime.QEncoding.Encode("utf-8", attachment.Filename)})
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+	if typ == "" || disposition == "" {
+		return fmt.Errorf("invalid content type %q", contentType)
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {typ},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {disposition},
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > 0 {
+		n := min(maxLineLength, len(encoded))
+		if _, err := part.Write([]byte(encoded[:n] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// encodeHeaderValue encodes a header value with RFC 2047 if it is not plain ASCII. Line breaks would end
+// the header, so they are replaced, and long values are folded between the encoded words.
+func encodeHeaderValue(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ReplaceAll(mime.QEncoding.Encode("utf-8", value), "?= =?", "?=\r\n =?")
+}
+
+// formatAddressList formats the addresses for an address header, display names are RFC 2047 encoded
+func formatAddressList(addresses []mail.Address) string {
+	parts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		parts = append(parts, address.String())
+	}
+	return strings.Join(parts, ",\r\n ")
+}
+
+// addressesOf returns the plain addresses without display names
+func addressesOf(addresses []mail.Address) []string {
+	list := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		list = append(list, address.Address)
+	}
+	return list
+}
+
+// newMailAddress creates a mail address with display name
+func newMailAddress(name, address string) mail.Address {
+	return mail.Address{Name: name, Address: address}
+}
+
+// newMessageID creates a random message id with the domain of the sender
+func newMessageID(sender string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to create message id: %v", err)
+	}
+
+	domain := "localhost"
+	if idx := strings.LastIndex(sender, "@"); idx >= 0 && idx < len(sender)-1 {
+		domain = sender[idx+1:]
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain), nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update rewrites the golden files with the current output: go test -run TestBuild -update
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// testBoundaries returns fixed boundaries, so the output can be compared with the golden files
+func testBoundaries() func() string {
+	n := 0
+	return func() string {
+		n++
+		return fmt.Sprintf("boundary-%d", n)
+	}
+}
+
+// newTestMessage returns a message with pinned date, message id and boundaries
+func newTestMessage() mailMessage {
+	return mailMessage{
+		From: mail.Address{Name: "Jürgen Müller", Address: "juergen@example.com"},
+		To: []mail.Address{
+			{Name: "Acme Accounting", Address: "accounting@example.com"},
+			{Address: "tax@example.com"},
+		},
+		Cc:        []mail.Address{{Name: "Büro", Address: "office@example.com"}},
+		ReplyTo:   []mail.Address{{Name: "Buchhaltung", Address: "replies@example.com"}},
+		Subject:   "Rechnung März – Nr. 42",
+		HTMLBody:  "<p>Grüße aus <b>Köln</b></p>",
+		PlainBody: "Grüße aus Köln",
+		Headers: []mailHeader{
+			{Name: "X-Customer-ID", Value: "K-4711"},
+			{Name: "List-Unsubscribe", Value: "<mailto:unsubscribe@example.com>"},
+		},
+		Date:        time.Date(2024, time.March, 5, 14, 30, 0, 0, time.FixedZone("CET", 3600)),
+		MessageID:   "<0123456789abcdef@example.com>",
+		newBoundary: testBoundaries(),
+	}
+}
+
+// checkGolden compares the output with testdata/name, or rewrites the file with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file, run with -update to create it: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s, run with -update if the change is intended:\n%s", path, got)
+	}
+}
+
+// headerNames returns the names of the header fields in the order they are written
+func headerNames(t *testing.T, data []byte) []string {
+	t.Helper()
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(data), "\r\n") {
+		if line == "" {
+			break
+		}
+		if name, _, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, " ") {
+			if _, exists := header[textproto.CanonicalMIMEHeaderKey(name)]; !exists {
+				t.Fatalf("header line %q was not parsed", line)
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func decodeHeader(t *testing.T, value string) string {
+	t.Helper()
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", value, err)
+	}
+	return decoded
+}
+
+func TestBuildAlternative(t *testing.T) {
+	data, err := newTestMessage().build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "alternative.eml", data)
+
+	wantOrder := []string{"Date", "From", "To", "Cc", "Reply-To", "Subject", "Message-ID", "X-Customer-ID", "List-Unsubscribe", "MIME-Version", "Content-Type"}
+	if got := headerNames(t, data); strings.Join(got, ",") != strings.Join(wantOrder, ",") {
+		t.Errorf("header order = %v, want %v", got, wantOrder)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := decodeHeader(t, msg.Header.Get("Subject")); got != "Rechnung März – Nr. 42" {
+		t.Errorf("Subject = %q", got)
+	}
+	if date, err := msg.Header.Date(); err != nil || !date.Equal(newTestMessage().Date) {
+		t.Errorf("Date = %v, %v", date, err)
+	}
+
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Jürgen Müller" || from[0].Address != "juergen@example.com" {
+		t.Errorf("From = %v, %v", from, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Acme Accounting" || to[1].Address != "tax@example.com" {
+		t.Errorf("To = %v, %v", to, err)
+	}
+	cc, err := msg.Header.AddressList("Cc")
+	if err != nil || len(cc) != 1 || cc[0].Name != "Büro" {
+		t.Errorf("Cc = %v, %v", cc, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %s, %v", mediaType, err)
+	}
+
+	// the multipart reader decodes the quoted-printable parts
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "Grüße aus Köln"},
+		{"text/html; charset=utf-8", "<p>Grüße aus <b>Köln</b></p>"},
+	} {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := part.Header.Get("Content-Type"); got != want.contentType {
+			t.Errorf("Content-Type = %q, want %q", got, want.contentType)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want.body {
+			t.Errorf("body = %q, want %q", body, want.body)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expected two parts, got %v", err)
+	}
+}
+
+func TestBuildHeaderInjection(t *testing.T) {
+	m := newTestMessage()
+	m.Subject = "Invoice\r\nBcc: attacker@example.com\r\n\r\nforged body"
+	m.Headers = []mailHeader{{Name: "X-Customer-ID", Value: "K-4711\r\nBcc: attacker@example.com"}}
+
+	data, err := m.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "injection.eml", data)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.Header["Bcc"]; ok {
+		t.Errorf("injected Bcc header found")
+	}
+	if got := decodeHeader(t, msg.Header.Get("Subject")); got != "Invoice Bcc: attacker@example.com forged body" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := decodeHeader(t, msg.Header.Get("X-Customer-ID")); got != "K-4711 Bcc: attacker@example.com" {
+		t.Errorf("X-Customer-ID = %q", got)
+	}
+}
+
+func TestBuildMixed(t *testing.T) {
+	m := newTestMessage()
+	m.Attachments = []mailAttachment{
+		{Filename: `Rechnung "März" ä.pdf`, ContentType: "application/pdf", Data: bytes.Repeat([]byte("%PDF-1.4 "), 20)},
+		{Filename: `Say "Hi".txt`, ContentType: "text/plain", Data: []byte("hello")},
+	}
+
+	data, err := m.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "mixed.eml", data)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %s, %v", mediaType, err)
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType != "multipart/alternative" {
+		t.Errorf("first part = %s, want multipart/alternative", mediaType)
+	}
+
+	for _, want := range m.Attachments {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// FileName decodes the RFC 2231 filename* parameter
+		if part.FileName() != want.Filename {
+			t.Errorf("filename = %q, want %q", part.FileName(), want.Filename)
+		}
+		mediaType, typeParams, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || mediaType != want.ContentType {
+			t.Errorf("Content-Type = %s, %v", mediaType, err)
+		}
+		if name := decodeHeader(t, typeParams["name"]); name != want.Filename {
+			t.Errorf("name = %q, want %q", name, want.Filename)
+		}
+		if part.Header.Get("Content-Transfer-Encoding") != "base64" {
+			t.Errorf("Content-Transfer-Encoding = %q", part.Header.Get("Content-Transfer-Encoding"))
+		}
+		encoded, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+			if len(line) > maxLineLength {
+				t.Errorf("line of %d characters exceeds %d", len(line), maxLineLength)
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+		if err != nil || !bytes.Equal(decoded, want.Data) {
+			t.Errorf("data of %s = %q, %v", want.Filename, decoded, err)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expected three parts, got %v", err)
+	}
+}
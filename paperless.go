@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// newPaperlessClientFromConfig creates a client based on the global config
+func newPaperlessClientFromConfig() *paperless.HTTPClient {
+	return paperless.NewClient(Config.Paperless.InstanceURL, Config.Paperless.InstanceToken, paperless.ClientOptions{
+		Timeout:  time.Duration(Config.Paperless.RequestTimeoutSeconds) * time.Second,
+		PageSize: Config.Paperless.PageSize,
+		Retry: paperless.RetryPolicy{
+			MaxAttempts: Config.Paperless.RetryMaxAttempts,
+			BaseDelay:   time.Duration(Config.Paperless.RetryBaseDelayMilliseconds) * time.Millisecond,
+			MaxDelay:    time.Duration(Config.Paperless.RetryMaxDelaySeconds) * time.Second,
+		},
+		TLSConfig: paperlessTLSConfig,
+	})
+}
+
+// getFileName returns the archived filename. For encrypted files it uses the original name.
+// If you are using a custom file format and the config variable "UseCustomFilenameFormat" is set to true, it returns the custom filename.
+func getFileName(d *paperless.Document) string {
+	if Config.Paperless.UseCustomFilenameFormat && d.MediaFilename != "" {
+		return d.MediaFilename
+	}
+
+	if d.FileName != "" {
+		return d.FileName
+	}
+	return d.OriginalFileName
+}
+
+// getDocumentURL returns the Url to the document inside Paperless
+func getDocumentURL(d *paperless.Document) string {
+	return fmt.Sprintf("%sdocuments/%d/details", Config.Paperless.InstanceURL, d.ID)
+}
@@ -0,0 +1,435 @@
+// Package paperless is a client for the REST api of paperless-ngx.
+package paperless
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client describes the calls against the paperless api
+type Client interface {
+	GetTags(ctx context.Context) ([]Tag, error)
+	GetCorrespondents(ctx context.Context) ([]Correspondent, error)
+	GetDocumentTypes(ctx context.Context) ([]DocumentType, error)
+	GetStoragePaths(ctx context.Context) ([]StoragePath, error)
+	GetUsers(ctx context.Context) ([]User, error)
+	GetCustomFields(ctx context.Context) ([]CustomField, error)
+	GetDocumentsByTags(ctx context.Context, queries []DocumentQuery) ([]Document, error)
+	DownloadDocumentBinary(ctx context.Context, doc Document, original bool) ([]byte, error)
+	AddTagToDocument(ctx context.Context, document Document, tag Tag) error
+	UpdateCustomFields(ctx context.Context, document Document, values []CustomFieldInstance) ([]CustomFieldInstance, error)
+	CreateShareLink(ctx context.Context, document Document, original bool, expiration time.Time) (ShareLink, error)
+	DeleteShareLink(ctx context.Context, link ShareLink) error
+}
+
+// HTTPClient implements Client with one shared http client
+type HTTPClient struct {
+	instanceURL string
+	token       string
+	pageSize    int
+	retry       RetryPolicy
+	httpClient  *http.Client
+}
+
+// ClientOptions holds the optional settings of a HTTPClient, zero values use the defaults
+type ClientOptions struct {
+	// Timeout limits every single request incl. reading the response body
+	Timeout time.Duration
+	// PageSize is the number of results fetched per request from collection endpoints
+	PageSize int
+	// Retry defines how transient failures are retried
+	Retry RetryPolicy
+	// TLSConfig replaces the default TLS settings of the transport, e.g. for a custom CA or a client certificate
+	TLSConfig *tls.Config
+}
+
+// DefaultRequestTimeout is used if no timeout is configured
+const DefaultRequestTimeout = 60 * time.Second
+
+// NewClient creates a client for the paperless instance at instanceURL
+func NewClient(instanceURL, token string, opts ClientOptions) *HTTPClient {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRequestTimeout
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultPageSize
+	}
+
+	// all requests share the same transport, so connections to paperless are reused
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 10
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+
+	return &HTTPClient{
+		instanceURL: instanceURL,
+		token:       token,
+		pageSize:    opts.PageSize,
+		retry:       opts.Retry.withDefaults(),
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+		},
+	}
+}
+
+// resolveURL makes a url returned by the server (e.g. `next` of a page) absolute.
+// Scheme and host are always taken from the instance url, as paperless may run behind a reverse proxy
+// and report its internal address.
+func (c *HTTPClient) resolveURL(ref string) (string, error) {
+	base, err := url.Parse(c.instanceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid instance url %s: %v", c.instanceURL, err)
+	}
+
+	u, err := base.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %s: %v", ref, err)
+	}
+	u.Scheme, u.Host = base.Scheme, base.Host
+
+	return u.String(), nil
+}
+
+// do sends the request, transient failures of idempotent methods are retried according to the retry policy
+func (c *HTTPClient) do(req *http.Request) (*http.Response, error) {
+	return c.send(req, isIdempotentMethod(req.Method))
+}
+
+// doRetryable is like do, but retries any method. The caller ensures that sending the request twice has no further effect.
+func (c *HTTPClient) doRetryable(req *http.Request) (*http.Response, error) {
+	return c.send(req, true)
+}
+
+// send adds the auth header and sends the request with the shared http client
+func (c *HTTPClient) send(req *http.Request, idempotent bool) (*http.Response, error) {
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.token))
+	return sendWithRetry(c.httpClient, req, c.retry, idempotent)
+}
+
+func (c *HTTPClient) getRequest(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch data: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *HTTPClient) GetCorrespondents(ctx context.Context) ([]Correspondent, error) {
+	result, err := collectAll[Correspondent](ctx, c, "api/correspondents/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch correspondents: %v", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPClient) GetDocumentTypes(ctx context.Context) ([]DocumentType, error) {
+	result, err := collectAll[DocumentType](ctx, c, "api/document_types/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch document types: %v", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPClient) GetStoragePaths(ctx context.Context) ([]StoragePath, error) {
+	result, err := collectAll[StoragePath](ctx, c, "api/storage_paths/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch storage paths: %v", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPClient) GetCustomFields(ctx context.Context) ([]CustomField, error) {
+	result, err := collectAll[CustomField](ctx, c, "api/custom_fields/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch custom fields: %v", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPClient) GetUsers(ctx context.Context) ([]User, error) {
+	result, err := collectAll[User](ctx, c, "api/users/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch users: %v", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPClient) GetTags(ctx context.Context) ([]Tag, error) {
+	result, err := collectAll[Tag](ctx, c, "api/tags/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tags: %v", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPClient) addMetaData(ctx context.Context, document *Document) error {
+	resp, err := c.getRequest(ctx, fmt.Sprintf("%sapi/documents/%d/metadata/", c.instanceURL, document.ID))
+	if err != nil {
+		return fmt.Errorf("failed to fetch meta data for document id=%d: %v", document.ID, err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(document)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DocumentQuery selects documents holding at least one of AnyTags and none of ExcludedTags
+type DocumentQuery struct {
+	AnyTags      []Tag
+	ExcludedTags []Tag
+}
+
+// values returns the filter parameters of the query for the documents endpoint
+func (q DocumentQuery) values() url.Values {
+	joinIDs := func(tags []Tag) string {
+		ids := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			ids = append(ids, strconv.Itoa(tag.ID))
+		}
+		return strings.Join(ids, ",")
+	}
+
+	query := url.Values{}
+	query.Set("tags__id__in", joinIDs(q.AnyTags))
+	if len(q.ExcludedTags) > 0 {
+		query.Set("tags__id__none", joinIDs(q.ExcludedTags))
+	}
+	return query
+}
+
+// GetDocumentsByTags returns the documents matching any of the queries, each document is returned once
+func (c *HTTPClient) GetDocumentsByTags(ctx context.Context, queries []DocumentQuery) ([]Document, error) {
+	var documents []Document
+	seen := make(map[int]bool)
+
+	for _, q := range queries {
+		it := newPageIterator[Document](ctx, c, "api/documents/", q.values())
+		for it.Next() {
+			if doc := it.Value(); !seen[doc.ID] {
+				seen[doc.ID] = true
+				documents = append(documents, doc)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, fmt.Errorf("failed to fetch documents: %v", err)
+		}
+	}
+
+	// add meta data to each document
+	for idx := range documents {
+		if err := c.addMetaData(ctx, &documents[idx]); err != nil {
+			return nil, err
+		}
+	}
+
+	return documents, nil
+}
+
+func (c *HTTPClient) AddTagToDocument(ctx context.Context, document Document, tag Tag) error {
+	url := fmt.Sprintf("%sapi/documents/bulk_edit/", c.instanceURL)
+
+	type payload struct {
+		Documents  []int          `json:"documents"`
+		Method     string         `json:"method"`
+		Parameters map[string]int `json:"parameters"`
+	}
+	p, b := payload{
+		Documents:  []int{document.ID},
+		Method:     "add_tag",
+		Parameters: map[string]int{"tag": tag.ID},
+	}, new(bytes.Buffer)
+
+	err := json.NewEncoder(b).Encode(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	// Create the request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, b)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set the necessary headers
+	req.Header.Set("Content-Type", "application/json")
+
+	// Send the request. Adding a tag twice does not change the document, so the
+	// bulk edit is safe to retry even though it is a POST.
+	resp, err := c.doRetryable(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check the response status
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bulk Edit failed, Unexpected server status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// UpdateCustomFields sets the values of the custom fields of a document and returns all custom fields of the document.
+// The values are merged with the current custom fields, as paperless replaces the whole list.
+func (c *HTTPClient) UpdateCustomFields(ctx context.Context, document Document, values []CustomFieldInstance) ([]CustomFieldInstance, error) {
+	merged := append([]CustomFieldInstance{}, document.CustomFields...)
+	for _, value := range values {
+		found := false
+		for idx := range merged {
+			if merged[idx].Field == value.Field {
+				merged[idx].Value = value.Value
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, value)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	err := json.NewEncoder(b).Encode(map[string][]CustomFieldInstance{"custom_fields": merged})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	url := fmt.Sprintf("%sapi/documents/%d/", c.instanceURL, document.ID)
+	req, err := http.NewRequestWithContext(ctx, "PATCH", url, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// setting the same values twice does not change the document, so the update is safe to retry
+	resp, err := c.doRetryable(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("custom field update failed, unexpected server status code: %d %s", resp.StatusCode, body)
+	}
+
+	return merged, nil
+}
+
+func (c *HTTPClient) DownloadDocumentBinary(ctx context.Context, doc Document, original bool) ([]byte, error) {
+	query := ""
+	if original {
+		query = "?original=true"
+	}
+	url := fmt.Sprintf("%sapi/documents/%d/download/%s", c.instanceURL, doc.ID, query)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download document ID %d: %s", doc.ID, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// CreateShareLink creates a public link to the archived or original file of the document. A zero expiration creates a link that never expires.
+func (c *HTTPClient) CreateShareLink(ctx context.Context, document Document, original bool, expiration time.Time) (ShareLink, error) {
+	var link ShareLink
+
+	p := map[string]any{
+		"document":     document.ID,
+		"file_version": "archive",
+		"expiration":   nil,
+	}
+	if original {
+		p["file_version"] = "original"
+	}
+	if !expiration.IsZero() {
+		p["expiration"] = expiration.UTC().Format(time.RFC3339)
+	}
+
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(p); err != nil {
+		return link, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%sapi/share_links/", c.instanceURL), b)
+	if err != nil {
+		return link, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// every request creates a new link, so it is not retried
+	resp, err := c.do(req)
+	if err != nil {
+		return link, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return link, fmt.Errorf("share link creation failed, unexpected server status code: %d %s", resp.StatusCode, body)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		return link, fmt.Errorf("failed to decode share link: %v", err)
+	}
+	link.URL = fmt.Sprintf("%sshare/%s", c.instanceURL, link.Slug)
+	return link, nil
+}
+
+// DeleteShareLink revokes the share link
+func (c *HTTPClient) DeleteShareLink(ctx context.Context, link ShareLink) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%sapi/share_links/%d/", c.instanceURL, link.ID), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// a link that is deleted already is accepted below, so the deletion is safe to retry
+	resp, err := c.doRetryable(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// a link that is gone already is fine
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("share link deletion failed, unexpected server status code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package paperless
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// Document represents a paperless Document
+type Document struct {
+	ID                int                   `json:"id"`
+	Title             string                `json:"title"`
+	FileName          string                `json:"archived_file_name"`
+	OriginalFileName  string                `json:"original_file_name"`
+	TagIDs            []int                 `json:"tags"`
+	CreatedAt         string                `json:"created"`
+	ModifiedAt        string                `json:"modified"`
+	CorrespondentId   int                   `json:"correspondent"`
+	DocumentTypeId    int                   `json:"document_type"`
+	StoragePath       int                   `json:"storage_path"`
+	OwnerId           int                   `json:"owner"`
+	MediaFilename     string                `json:"media_filename"`
+	Size              int                   `json:"original_size"`
+	OriginalChecksum  string                `json:"original_checksum"`
+	ArchiveChecksum   string                `json:"archive_checksum"`
+	OriginalMimeType  string                `json:"original_mime_type"`
+	HasArchiveVersion bool                  `json:"has_archive_version"`
+	CustomFields      []CustomFieldInstance `json:"custom_fields"`
+	Notes             []Note                `json:"notes"`
+}
+
+// Note represents a note on a paperless document
+type Note struct {
+	ID      int      `json:"id"`
+	Note    string   `json:"note"`
+	Created string   `json:"created"`
+	User    NoteUser `json:"user"`
+}
+
+// NoteUser is the author of a note
+type NoteUser User
+
+// UnmarshalJSON supports both formats of the author, older paperless versions only return the user id
+func (u *NoteUser) UnmarshalJSON(data []byte) error {
+	var id int
+	if err := json.Unmarshal(data, &id); err == nil {
+		*u = NoteUser{ID: id}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*User)(u))
+}
+
+// Checksum returns the checksum of the document content, it changes if the file in paperless is replaced
+func (d *Document) Checksum() string {
+	if d.OriginalChecksum != "" {
+		return d.OriginalChecksum
+	}
+	return d.ArchiveChecksum
+}
+
+// HasTag returns true if the document holds the tag
+func (d *Document) HasTag(id int) bool {
+	for _, tagID := range d.TagIDs {
+		if tagID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// HasArchivedFile returns true if paperless created an archived PDF of the document.
+// Without an archived version paperless always serves the original file.
+func (d *Document) HasArchivedFile() bool {
+	return d.HasArchiveVersion || d.FileName != ""
+}
+
+// ContentType returns the content type of the downloaded file. The archived version is always a PDF,
+// the type of the original comes from the paperless metadata or is sniffed from the content.
+func (d *Document) ContentType(data []byte, original bool) string {
+	if !original && d.HasArchivedFile() {
+		return "application/pdf"
+	}
+	if d.OriginalMimeType != "" {
+		return d.OriginalMimeType
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// ShareLink is a public link to a document in paperless
+type ShareLink struct {
+	ID          int        `json:"id"`
+	Slug        string     `json:"slug"`
+	Document    int        `json:"document"`
+	Expiration  *time.Time `json:"expiration"`
+	FileVersion string     `json:"file_version"`
+	// URL is the public address of the link, it is built from the instance URL and the slug
+	URL string `json:"-"`
+}
+
+// Tag represents a paperless Tag
+type Tag struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Correspondent represents a paperless correspondent
+type Correspondent struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// DocumentType represents a paperless documentType
+type DocumentType struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// StoragePath represents a paperless storagePath
+type StoragePath struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// User represents a paperless user e.g. owner
+type User struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+}
+
+// CustomField represents the definition of a paperless custom field
+type CustomField struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	DataType  string `json:"data_type"`
+	ExtraData struct {
+		SelectOptions []SelectOption `json:"select_options"`
+	} `json:"extra_data"`
+}
+
+// SelectOption is an option of a custom field with data type select
+type SelectOption struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+// UnmarshalJSON supports both formats of select options. Older paperless versions store plain
+// strings and reference them by index, newer versions store objects with an id.
+func (o *SelectOption) UnmarshalJSON(data []byte) error {
+	var label string
+	if err := json.Unmarshal(data, &label); err == nil {
+		o.ID, o.Label = "", label
+		return nil
+	}
+
+	type option SelectOption
+	return json.Unmarshal(data, (*option)(o))
+}
+
+// CustomFieldInstance is the value of a custom field on a document
+type CustomFieldInstance struct {
+	Field int `json:"field"`
+	Value any `json:"value"`
+}
+
+// CorrespondentByID returns the correspondent with the id, or nil
+func CorrespondentByID(correspondents []Correspondent, id int) *Correspondent {
+	for _, correspondent := range correspondents {
+		if correspondent.ID == id {
+			return &correspondent
+		}
+	}
+	return nil
+}
+
+// DocumentTypeByID returns the document type with the id, or nil
+func DocumentTypeByID(documentTypes []DocumentType, id int) *DocumentType {
+	for _, documentType := range documentTypes {
+		if documentType.ID == id {
+			return &documentType
+		}
+	}
+	return nil
+}
+
+// StoragePathByID returns the storage path with the id, or nil
+func StoragePathByID(storagePaths []StoragePath, id int) *StoragePath {
+	for _, storagePath := range storagePaths {
+		if storagePath.ID == id {
+			return &storagePath
+		}
+	}
+	return nil
+}
+
+// UserByID returns the user with the id, or nil
+func UserByID(users []User, id int) *User {
+	for _, user := range users {
+		if user.ID == id {
+			return &user
+		}
+	}
+	return nil
+}
+
+// CustomFieldByID returns the custom field with the id, or nil
+func CustomFieldByID(customFields []CustomField, id int) *CustomField {
+	for _, customField := range customFields {
+		if customField.ID == id {
+			return &customField
+		}
+	}
+	return nil
+}
+
+// CustomFieldByName returns the custom field with the name, or nil
+func CustomFieldByName(customFields []CustomField, name string) *CustomField {
+	for _, customField := range customFields {
+		if customField.Name == name {
+			return &customField
+		}
+	}
+	return nil
+}
+
+// TagByID returns the tag with the id, or nil
+func TagByID(tags []Tag, id int) *Tag {
+	for _, tag := range tags {
+		if tag.ID == id {
+			return &tag
+		}
+	}
+	return nil
+}
+
+// TagByName returns the tag with the name, or nil
+func TagByName(tags []Tag, name string) *Tag {
+	for _, tag := range tags {
+		if tag.Name == name {
+			return &tag
+		}
+	}
+	return nil
+}
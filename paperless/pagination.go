@@ -0,0 +1,115 @@
+package paperless
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// defaultPageSize is the number of results requested per page if no page size is configured
+const defaultPageSize = 100
+
+// pageIterator streams the results of a paginated paperless collection endpoint.
+// It follows the `next` url returned by the server, so only one page is held in memory
+// and every response body is closed before the next page is requested.
+//
+//	it := newPageIterator[Tag](ctx, c, "api/tags/", nil)
+//	for it.Next() {
+//		tag := it.Value()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type pageIterator[T any] struct {
+	ctx    context.Context
+	client *HTTPClient
+	next   string
+	page   []T
+	idx    int
+	err    error
+}
+
+// newPageIterator creates an iterator for the endpoint path (relative to the instance url) with the given query
+func newPageIterator[T any](ctx context.Context, c *HTTPClient, path string, query url.Values) *pageIterator[T] {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("page_size", fmt.Sprintf("%d", c.pageSize))
+
+	return &pageIterator[T]{
+		ctx:    ctx,
+		client: c,
+		next:   fmt.Sprintf("%s%s?%s", c.instanceURL, path, query.Encode()),
+		idx:    -1,
+	}
+}
+
+// Next advances to the next result and fetches the next page if needed.
+// It returns false if all results are consumed or an error occurred.
+func (it *pageIterator[T]) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.idx++
+	for it.idx >= len(it.page) {
+		if it.next == "" {
+			return false
+		}
+		if err := it.fetch(); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// Value returns the current result
+func (it *pageIterator[T]) Value() T {
+	return it.page[it.idx]
+}
+
+// Err returns the first error that occurred while fetching pages
+func (it *pageIterator[T]) Err() error {
+	return it.err
+}
+
+// fetch loads the page behind the next url
+func (it *pageIterator[T]) fetch() error {
+	pageURL, err := it.client.resolveURL(it.next)
+	if err != nil {
+		return err
+	}
+
+	resp, err := it.client.getRequest(it.ctx, pageURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Results []T    `json:"results"`
+		Next    string `json:"next"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode page %s: %v", pageURL, err)
+	}
+
+	it.page, it.idx, it.next = result.Results, 0, result.Next
+	return nil
+}
+
+// collectAll reads all pages of an endpoint into one slice
+func collectAll[T any](ctx context.Context, c *HTTPClient, path string, query url.Values) ([]T, error) {
+	var all []T
+
+	it := newPageIterator[T](ctx, c, path, query)
+	for it.Next() {
+		all = append(all, it.Value())
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
@@ -0,0 +1,62 @@
+package paperless
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaginationFollowsNext(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		if r.URL.Path != "/api/tags/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// behind a reverse proxy paperless reports its internal address in `next`
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprint(w, `{"count":2,"next":"http://paperless.internal:8000/api/tags/?page=2&page_size=1","results":[{"id":1,"name":"Invoice"}]}`)
+		case "2":
+			fmt.Fprint(w, `{"count":2,"next":null,"results":[{"id":2,"name":"Sent"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL+"/", "secret", ClientOptions{PageSize: 1})
+	tags, err := client.GetTags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 2 || tags[0].Name != "Invoice" || tags[1].Name != "Sent" {
+		t.Errorf("tags = %+v", tags)
+	}
+	want := []string{"/api/tags/?page_size=1", "/api/tags/?page=2&page_size=1"}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+}
+
+func TestResolveURL(t *testing.T) {
+	c := &HTTPClient{instanceURL: "https://paperless.example.com/paperless/"}
+
+	tests := []struct{ ref, want string }{
+		{"http://paperless.internal:8000/paperless/api/tags/?page=2", "https://paperless.example.com/paperless/api/tags/?page=2"},
+		{"/paperless/api/tags/?page=3", "https://paperless.example.com/paperless/api/tags/?page=3"},
+		{"api/tags/?page=4", "https://paperless.example.com/paperless/api/tags/?page=4"},
+	}
+
+	for _, tt := range tests {
+		got, err := c.resolveURL(tt.ref)
+		if err != nil || got != tt.want {
+			t.Errorf("resolveURL(%q) = %q, %v, want %q", tt.ref, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package paperless
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaults of the retry policy, used if nothing is configured
+const (
+	defaultRetryMaxAttempts = 5
+	defaultRetryBaseDelay   = 1 * time.Second
+	defaultRetryMaxDelay    = 30 * time.Second
+
+	// maxRetryAfter caps the delay a server may request with a Retry-After header
+	maxRetryAfter = 5 * time.Minute
+)
+
+// RetryPolicy defines how often and how long to wait before a failed paperless request is sent again
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts incl. the first one, 1 disables retries
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it is doubled with every further attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff
+	MaxDelay time.Duration
+}
+
+// withDefaults replaces unset values of the policy with the defaults
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry (starting at 1).
+// The delay grows exponentially and is randomized between half and the full value, so several
+// instances don't hit paperless at the same time after a restart.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isTransientStatus returns true for status codes that are worth a retry, e.g. while paperless
+// restarts or a reverse proxy can't reach it
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isIdempotentMethod returns true for methods that can be sent twice without side effects
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads the Retry-After header, which holds either seconds or an http date.
+// The delay is capped at maxRetryAfter.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	var d time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		d = max(date.Sub(now), 0)
+	} else {
+		return 0, false
+	}
+	return min(d, maxRetryAfter), true
+}
+
+// sendWithRetry sends the request and retries transient failures according to the policy.
+// Only idempotent requests are retried, all others are sent exactly once.
+func sendWithRetry(client *http.Client, req *http.Request, policy RetryPolicy, idempotent bool) (*http.Response, error) {
+	if !idempotent {
+		return client.Do(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+
+		// context is done, retrying would fail anyway
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if err == nil {
+				err = ctxErr
+			}
+			return nil, err
+		}
+
+		if err == nil && !isTransientStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		if attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && retryAfter > delay {
+				delay = retryAfter
+			}
+			resp.Body.Close()
+		}
+
+		log.Printf("request %s %s failed (%s), retry %d/%d in %s", req.Method, req.URL.Redacted(), reason, attempt, policy.MaxAttempts-1, delay.Round(time.Millisecond))
+
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+
+		// the body was consumed by the previous attempt and has to be recreated
+		if req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to reset request body for retry: %v", err)
+			}
+			req.Body = body
+		}
+	}
+}
+
+// sleepContext waits for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,184 @@
+package paperless
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for the server with short retry delays
+func newTestClient(instanceURL string) *HTTPClient {
+	return NewClient(instanceURL, "secret", ClientOptions{
+		Retry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond},
+	})
+}
+
+func TestRetryTransientStatus(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	resp, err := newTestClient(srv.URL+"/").getRequest(context.Background(), srv.URL+"/api/tags/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := newTestClient(srv.URL+"/").getRequest(context.Background(), srv.URL+"/api/tags/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the backoff of the policy is a few milliseconds, the server asked for a second
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least 1s", elapsed)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+func TestNoRetryForPost(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/share_links/", strings.NewReader(`{"document":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newTestClient(srv.URL + "/").do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", resp.StatusCode)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestRetryResendsBody(t *testing.T) {
+	const body = `{"documents":[1],"method":"add_tag","parameters":{"tag":2}}`
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil || string(data) != body {
+			t.Errorf("attempt %d: body = %q, %v", calls.Load()+1, data, err)
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/documents/bulk_edit/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newTestClient(srv.URL + "/").doRetryable(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{"3600", maxRetryAfter, true},
+		{"Tue, 05 Mar 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 05 Mar 2024 11:59:00 GMT", 0, true},
+		{"Tue, 05 Mar 2024 13:00:00 GMT", maxRetryAfter, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.header, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{20, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := policy.backoff(tt.retry); got < tt.max/2 || got > tt.max {
+				t.Errorf("backoff(%d) = %s, want between %s and %s", tt.retry, got, tt.max/2, tt.max)
+			}
+		}
+	}
+}
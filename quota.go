@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSendQuotaPath is used if no path for the send quota is configured
+const defaultSendQuotaPath = "config/send_quota.json"
+
+// rateLimit allows max mails within the window
+type rateLimit struct {
+	max    int
+	window time.Duration
+	name   string
+}
+
+// quotaExceededError is returned if a rate limit of the SMTP account does not allow another mail
+type quotaExceededError struct {
+	Limit   rateLimit
+	ResetAt time.Time
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("send quota of %d mails per %s is used up until %s", e.Limit.max, e.Limit.name, e.ResetAt.Format(time.RFC3339))
+}
+
+// SendQuota keeps the times of the mails sent within the last day per SMTP account, so the rate limits
+// hold across runs and restarts of the service.
+type SendQuota struct {
+	path string
+	mu   sync.Mutex
+	sent map[string][]time.Time
+}
+
+// OpenSendQuota loads the send quota from path, a missing file results in an empty quota
+func OpenSendQuota(path string) (*SendQuota, error) {
+	q := &SendQuota{
+		path: path,
+		sent: make(map[string][]time.Time),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read send quota %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, &q.sent); err != nil {
+		return nil, fmt.Errorf("failed to parse send quota %s: %v", path, err)
+	}
+	return q, nil
+}
+
+// quotaKey identifies the account the provider counts the mails of
+func quotaKey(account SMTPAccount) string {
+	if account.hasCredentials() {
+		return account.SMTPUser + "@" + account.SMTPServer
+	}
+	return account.SMTPAddress + "@" + account.SMTPServer
+}
+
+// check returns a *quotaExceededError if a rate limit of the account does not allow n more mails yet.
+// More mails than a limit allows at all fail with a plain error.
+func (q *SendQuota) check(account SMTPAccount, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, limit := range account.getRateLimits() {
+		if n > limit.max {
+			return fmt.Errorf("%d mails exceed the send quota of %d mails per %s", n, limit.max, limit.name)
+		}
+		times := q.within(account, limit.window, now)
+		if len(times)+n > limit.max {
+			// a mail leaves the window once it is older than the window, the oldest one first
+			resetAt := times[len(times)+n-limit.max-1].Add(limit.window)
+			return &quotaExceededError{Limit: limit, ResetAt: resetAt}
+		}
+	}
+	return nil
+}
+
+// remaining describes the remaining mails of every rate limit of the account for logging
+func (q *SendQuota) remaining(account SMTPAccount) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var parts []string
+	for _, limit := range account.getRateLimits() {
+		left := limit.max - len(q.within(account, limit.window, now))
+		if left < 0 {
+			left = 0
+		}
+		parts = append(parts, fmt.Sprintf("%d of %d mails per %s", left, limit.max, limit.name))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// within returns the send times of the account within the window before now, oldest first
+func (q *SendQuota) within(account SMTPAccount, window time.Duration, now time.Time) []time.Time {
+	times := q.sent[quotaKey(account)]
+	for idx, t := range times {
+		if now.Sub(t) < window {
+			return times[idx:]
+		}
+	}
+	return nil
+}
+
+// record adds a sent mail to the quota of the account, accounts without rate limits are not recorded
+func (q *SendQuota) record(account SMTPAccount) error {
+	if len(account.getRateLimits()) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	key := quotaKey(account)
+	// only the day is kept, it is the longest window
+	q.sent[key] = append(q.within(account, 24*time.Hour, now), now)
+	return q.save()
+}
+
+// save writes the quota, see writeFileAtomic
+func (q *SendQuota) save() error {
+	data, err := json.MarshalIndent(q.sent, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode send quota: %v", err)
+	}
+
+	if err := writeFileAtomic(q.path, data); err != nil {
+		return fmt.Errorf("failed to write send quota: %v", err)
+	}
+	return nil
+}
+
+// logSendQuota logs the remaining quota of the account, if it has rate limits
+func logSendQuota(quota *SendQuota, account SMTPAccount) {
+	if quota == nil || len(account.getRateLimits()) == 0 {
+		return
+	}
+	log.Printf("remaining send quota of %s: %s", account.SMTPAddress, quota.remaining(account))
+}
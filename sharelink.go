@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// delivery modes of a rule
+const (
+	// deliveryAttachment attaches the files of the document to the mail
+	deliveryAttachment = "attachment"
+	// deliveryLink sends a paperless share link instead of the files
+	deliveryLink = "link"
+)
+
+// defaultShareLinkExpiryDays is used if a rule with link delivery sets no expiry
+const defaultShareLinkExpiryDays = 7
+
+// defaultShareLinkLogPath is used if no path for the share link log is configured
+const defaultShareLinkLogPath = "config/share_links.jsonl"
+
+// shareLinkRecord is a line of the share link log, it keeps the id of every link that was sent, so it can be revoked later
+type shareLinkRecord struct {
+	ShareLinkID int        `json:"share_link_id"`
+	DocumentID  int        `json:"document_id"`
+	Rule        string     `json:"rule"`
+	URL         string     `json:"url"`
+	FileVersion string     `json:"file_version"`
+	Expiration  *time.Time `json:"expiration"`
+	SentAt      time.Time  `json:"sent_at"`
+}
+
+// createShareLink creates the share link of the document for the rule. The link points to the original file if the
+// attachment policy of the rule is "original", to the archived file otherwise.
+func createShareLink(ctx context.Context, client paperless.Client, doc *paperless.Document, r rule) (paperless.ShareLink, error) {
+	var expiration time.Time
+	if days := r.getShareLinkExpiryDays(); days > 0 {
+		expiration = time.Now().AddDate(0, 0, days)
+	}
+
+	link, err := client.CreateShareLink(ctx, *doc, r.getAttachmentPolicy() == attachmentOriginal, expiration)
+	if err != nil {
+		return link, fmt.Errorf("failed to create share link for document '%s' (%d): %v", getFileName(doc), doc.ID, err)
+	}
+	log.Printf("created share link %d for document '%s' (%d)", link.ID, getFileName(doc), doc.ID)
+	return link, nil
+}
+
+// revokeShareLink deletes a share link that was not sent, errors are only logged
+func revokeShareLink(ctx context.Context, client paperless.Client, link paperless.ShareLink) {
+	if err := client.DeleteShareLink(ctx, link); err != nil {
+		log.Printf("warning: could not revoke unsent share link %d of document %d: %v", link.ID, link.Document, err)
+	}
+}
+
+// recordShareLink appends the sent share link to the share link log
+func recordShareLink(link paperless.ShareLink, ruleName string) error {
+	data, err := json.Marshal(shareLinkRecord{
+		ShareLinkID: link.ID,
+		DocumentID:  link.Document,
+		Rule:        ruleName,
+		URL:         link.URL,
+		FileVersion: link.FileVersion,
+		Expiration:  link.Expiration,
+		SentAt:      time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode share link: %v", err)
+	}
+
+	f, err := os.OpenFile(Config.getShareLinkLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write share link log: %v", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write share link log: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write share link log: %v", err)
+	}
+	return nil
+}
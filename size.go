@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+)
+
+// policies for mails exceeding the maximum message size
+const (
+	oversizeFail  = "fail"
+	oversizeSplit = "split"
+	oversizeLink  = "link"
+)
+
+// messageSizeMargin is reserved for header, body and MIME structure when attachments are packed into parts
+const messageSizeMargin = 64 * 1024
+
+// messageTooLargeError is returned if a mail exceeds the configured maximum size or the SIZE of the SMTP server
+type messageTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *messageTooLargeError) Error() string {
+	return fmt.Sprintf("mail of %s exceeds the maximum message size of %s", formatSize(e.Size), formatSize(e.Limit))
+}
+
+// formatSize formats a size in bytes for logging
+func formatSize(size int) string {
+	if size < 1024*1024 {
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+}
+
+// estimatedAttachmentSize returns the size of the attachment in the mail, base64 adds a third and a line break every 76 chars
+func estimatedAttachmentSize(attachment mailAttachment) int {
+	encoded := (len(attachment.Data) + 2) / 3 * 4
+	return encoded + encoded/maxLineLength*2 + 512
+}
+
+// packParts distributes units of attachments into parts that stay below the limit, a unit is never split.
+// It returns the indexes of the units of each part and the indexes of units that exceed the limit on their own.
+func packParts(units [][]mailAttachment, baseSize, limit int) ([][]int, []int) {
+	var parts [][]int
+	var oversized []int
+
+	current, currentSize := []int(nil), baseSize
+	for idx, unit := range units {
+		size := 0
+		for _, attachment := range unit {
+			size += estimatedAttachmentSize(attachment)
+		}
+
+		if baseSize+size > limit {
+			oversized = append(oversized, idx)
+			continue
+		}
+		if currentSize+size > limit {
+			parts = append(parts, current)
+			current, currentSize = nil, baseSize
+		}
+		current = append(current, idx)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts, oversized
+}
+
+// estimatedBaseSize returns the size of the mail without attachments, quoted-printable may triple the bodies
+func estimatedBaseSize(mail renderedMail) int {
+	return 3*(len(mail.Header)+len(mail.Body)+len(mail.PlainBody)) + messageSizeMargin
+}
+
+// withPartHeader appends the part number to the header of a mail that is split into several parts
+func withPartHeader(mail renderedMail, part, parts int) renderedMail {
+	if parts > 1 {
+		mail.Header = fmt.Sprintf("%s (part %d of %d)", mail.Header, part, parts)
+	}
+	return mail
+}
+
+// withDocumentLinks appends the paperless links of the documents to the bodies, it replaces the attachments of a mail that is too large
+func withDocumentLinks(mail renderedMail, docs []*paperless.Document) renderedMail {
+	var htmlLinks, plainLinks []string
+	for _, doc := range docs {
+		htmlLinks = append(htmlLinks, fmt.Sprintf(`<li><a href="%s">%s</a></li>`, html.EscapeString(getDocumentURL(doc)), html.EscapeString(doc.Title)))
+		plainLinks = append(plainLinks, fmt.Sprintf("- %s: %s", doc.Title, getDocumentURL(doc)))
+	}
+
+	mail.Body += "<p>The documents are too large to be sent by mail, open them in Paperless:</p><ul>" + strings.Join(htmlLinks, "") + "</ul>"
+	if mail.PlainBody != "" {
+		mail.PlainBody += "\n\nThe documents are too large to be sent by mail, open them in Paperless:\n" + strings.Join(plainLinks, "\n") + "\n"
+	}
+	return mail
+}
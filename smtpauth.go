@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP authentication mechanisms
+const (
+	// authAuto picks the first mechanism of authPreference the server offers
+	authAuto    = "auto"
+	authPlain   = "plain"
+	authLogin   = "login"
+	authCRAMMD5 = "cram-md5"
+	authXOAuth2 = "xoauth2"
+)
+
+// authPreference is the order authAuto tries the mechanisms in, XOAUTH2 is only used if it is configured
+var authPreference = []string{authPlain, authLogin, authCRAMMD5}
+
+// authenticate logs in with the configured mechanism, or with the best one the server offers for authAuto.
+// The mechanisms of the server are taken from the AUTH extension of its EHLO reply.
+func authenticate(client *smtp.Client, account SMTPAccount) error {
+	// the validator only allows credentials on connections without TLS if SMTPAllowInsecureAuth is set,
+	// the check is repeated here, as an opportunistic connection may stay unencrypted
+	if _, encrypted := client.TLSConnectionState(); !encrypted && !account.SMTPAllowInsecureAuth {
+		return fmt.Errorf("refusing to send credentials over an unencrypted connection, set SMTPAllowInsecureAuth to allow it")
+	}
+
+	ok, offered := client.Extension("AUTH")
+	if !ok {
+		return fmt.Errorf("server does not offer authentication")
+	}
+	mechanisms := strings.Fields(strings.ToLower(offered))
+
+	mechanism := account.getAuthMechanism()
+	if mechanism == authAuto {
+		mechanism = ""
+		for _, candidate := range authPreference {
+			if containsString(mechanisms, candidate) {
+				mechanism = candidate
+				break
+			}
+		}
+		if mechanism == "" {
+			return fmt.Errorf("server offers none of the supported auth mechanisms, it offers: %s", offered)
+		}
+	} else if !containsString(mechanisms, mechanism) {
+		return fmt.Errorf("server does not offer auth mechanism %s, it offers: %s", strings.ToUpper(mechanism), offered)
+	}
+
+	var auth smtp.Auth
+	switch mechanism {
+	case authPlain:
+		auth = &plainAuth{username: account.SMTPUser, password: account.SMTPPassword}
+	case authLogin:
+		auth = &loginAuth{username: account.SMTPUser, password: account.SMTPPassword}
+	case authCRAMMD5:
+		auth = smtp.CRAMMD5Auth(account.SMTPUser, account.SMTPPassword)
+	case authXOAuth2:
+		token, err := getOAuth2TokenSource(account).Token()
+		if err != nil {
+			return fmt.Errorf("failed to get oauth2 token: %v", err)
+		}
+		auth = &xoauth2Auth{username: account.SMTPUser, token: token}
+	}
+
+	if err := client.Auth(auth); err != nil {
+		return fmt.Errorf("failed to authenticate with %s: %v", strings.ToUpper(mechanism), err)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// plainAuth implements the AUTH PLAIN mechanism. Unlike smtp.PlainAuth it does not refuse unencrypted
+// connections on its own, authenticate checks the connection before.
+type plainAuth struct {
+	username string
+	password string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+	return nil, nil
+}
+
+// loginAuth implements the AUTH LOGIN mechanism, the server prompts for username and password
+type loginAuth struct {
+	username string
+	password string
+	step     int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// most servers prompt with "Username:" and "Password:", others send different or empty prompts
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	a.step++
+	switch {
+	case strings.HasPrefix(prompt, "username"), strings.HasPrefix(prompt, "user name"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	case a.step == 1:
+		return []byte(a.username), nil
+	case a.step == 2:
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism of Google and Microsoft
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends a json error, an empty reply makes it finish with the error code
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// oauth2RequestTimeout limits a token request
+const oauth2RequestTimeout = 60 * time.Second
+
+// oauth2TokenRefreshMargin renews a token before it expires, so it does not expire during a session
+const oauth2TokenRefreshMargin = time.Minute
+
+// oauth2TokenSource fetches access tokens with the client credentials or the refresh token flow and caches them until they expire
+type oauth2TokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+
+	mu           sync.Mutex
+	refreshToken string
+	accessToken  string
+	expiry       time.Time
+}
+
+// oauth2TokenSources holds one token source per account, so tokens are reused across mails and runs
+var (
+	oauth2TokenSourcesMu sync.Mutex
+	oauth2TokenSources   = make(map[string]*oauth2TokenSource)
+)
+
+// getOAuth2TokenSource returns the token source of the account
+func getOAuth2TokenSource(account SMTPAccount) *oauth2TokenSource {
+	oauth2TokenSourcesMu.Lock()
+	defer oauth2TokenSourcesMu.Unlock()
+
+	key := account.SMTPOAuthTokenURL + "|" + account.SMTPOAuthClientID + "|" + account.SMTPUser
+	source, ok := oauth2TokenSources[key]
+	if !ok {
+		source = &oauth2TokenSource{
+			tokenURL:     account.SMTPOAuthTokenURL,
+			clientID:     account.SMTPOAuthClientID,
+			clientSecret: account.SMTPOAuthClientSecret,
+			scopes:       account.SMTPOAuthScopes,
+			refreshToken: account.SMTPOAuthRefreshToken,
+		}
+		oauth2TokenSources[key] = source
+	}
+	return source
+}
+
+// Token returns a valid access token, it is refreshed if it expires soon
+func (s *oauth2TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accessToken != "" && time.Now().Add(oauth2TokenRefreshMargin).Before(s.expiry) {
+		return s.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("client_id", s.clientID)
+	if s.clientSecret != "" {
+		form.Set("client_secret", s.clientSecret)
+	}
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+	if s.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oauth2RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read token response: %v", err)
+	}
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("failed to decode token response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		if token.Error != "" {
+			return "", fmt.Errorf("token request failed with status %d: %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+		}
+		return "", errors.New("token request failed: " + resp.Status)
+	}
+
+	s.accessToken = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.ExpiresIn == 0 {
+		// without expiry the token is renewed for every session
+		s.expiry = time.Now()
+	}
+	// some providers rotate the refresh token with every refresh
+	if token.RefreshToken != "" {
+		s.refreshToken = token.RefreshToken
+	}
+	return s.accessToken, nil
+}
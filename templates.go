@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/carlosz1986/paperless-mailservice/paperless"
+	"github.com/spf13/viper"
+)
+
+// TemplateData is the data model of the mail header, body and custom field values. Entities that don't
+// exist for a document (e.g. no correspondent) are empty, so `{{.Correspondent.Name}}` never fails.
+type TemplateData struct {
+	Document      TemplateDocument
+	Tags          []paperless.Tag
+	TagNames      []string
+	Correspondent paperless.Correspondent
+	DocumentType  paperless.DocumentType
+	StoragePath   paperless.StoragePath
+	Owner         paperless.User
+	// CustomFields maps the name of a custom field to its value as text, e.g. `{{index .CustomFields "Invoice Number"}}`
+	CustomFields map[string]string
+	Notes        []paperless.Note
+	Rule         TemplateRule
+	// SentAt is the time of sending
+	SentAt time.Time
+	// Documents holds the data of every document of a digest, the other document fields are empty in a digest
+	Documents []TemplateData
+	// ShareLink is the paperless share link of the document, it is only set for rules with link delivery
+	ShareLink TemplateShareLink
+	// Part and PartCount number the mails of a digest split because of its size, both are 1 otherwise
+	Part      int
+	PartCount int
+}
+
+// TemplateDocument holds the document fields available in templates
+type TemplateDocument struct {
+	ID               int
+	Title            string
+	FileName         string
+	OriginalFileName string
+	URL              string
+	CreatedAt        string
+	ModifiedAt       string
+}
+
+// TemplateShareLink holds the share link fields available in templates
+type TemplateShareLink struct {
+	ID  int
+	URL string
+	// Expiration is zero for links that never expire
+	Expiration time.Time
+}
+
+// newTemplateShareLink returns the template fields of the share link
+func newTemplateShareLink(link paperless.ShareLink) TemplateShareLink {
+	t := TemplateShareLink{ID: link.ID, URL: link.URL}
+	if link.Expiration != nil {
+		t.Expiration = *link.Expiration
+	}
+	return t
+}
+
+// TemplateRule holds the rule fields available in templates
+type TemplateRule struct {
+	Name string
+	// ReceiverAddresses and BCCAddresses are the rendered addresses of the mail, in the receiver templates
+	// themselves they are the configured templates
+	ReceiverAddresses []string
+	BCCAddresses      []string
+}
+
+// newTemplateData creates the template data of a document sent by the rule
+func newTemplateData(d *documentData, r rule, sentAt time.Time) TemplateData {
+	data := TemplateData{
+		Document: TemplateDocument{
+			ID:               d.Document.ID,
+			Title:            d.Document.Title,
+			FileName:         getFileName(d.Document),
+			OriginalFileName: d.Document.OriginalFileName,
+			URL:              getDocumentURL(d.Document),
+			CreatedAt:        d.Document.CreatedAt,
+			ModifiedAt:       d.Document.ModifiedAt,
+		},
+		Tags:         d.Tags,
+		CustomFields: make(map[string]string),
+		Notes:        d.Document.Notes,
+		Rule:         newTemplateRule(r),
+		SentAt:       sentAt,
+		Part:         1,
+		PartCount:    1,
+	}
+
+	for _, tag := range d.Tags {
+		data.TagNames = append(data.TagNames, tag.Name)
+	}
+	if d.Correspondent != nil {
+		data.Correspondent = *d.Correspondent
+	}
+	if d.DocumentType != nil {
+		data.DocumentType = *d.DocumentType
+	}
+	if d.StoragePath != nil {
+		data.StoragePath = *d.StoragePath
+	}
+	if d.Owner != nil {
+		data.Owner = *d.Owner
+	}
+	for _, value := range d.CustomFields {
+		data.CustomFields[value.Field.Name] = value.Text()
+	}
+	return data
+}
+
+// newTemplateRule returns the template fields of the rule
+func newTemplateRule(r rule) TemplateRule {
+	return TemplateRule{
+		Name:              r.Name,
+		ReceiverAddresses: r.ReceiverAddresses,
+		BCCAddresses:      r.BCCAddresses,
+	}
+}
+
+// withReceivers returns the data with the rendered receivers of the mail in .Rule
+func (d TemplateData) withReceivers(mail renderedMail) TemplateData {
+	d.Rule.ReceiverAddresses = addressesOf(mail.To)
+	d.Rule.BCCAddresses = addressesOf(mail.BCC)
+	return d
+}
+
+// newDigestTemplateData creates the template data of a digest mail with the documents of the items
+func newDigestTemplateData(items []digestItem, r rule, sentAt time.Time) TemplateData {
+	data := TemplateData{
+		CustomFields: make(map[string]string),
+		Rule:         newTemplateRule(r),
+		SentAt:       sentAt,
+		Part:         1,
+		PartCount:    1,
+	}
+	for _, item := range items {
+		document := newTemplateData(item.data, r, sentAt)
+		if item.shareLink != nil {
+			document.ShareLink = newTemplateShareLink(*item.shareLink)
+		}
+		data.Documents = append(data.Documents, document)
+	}
+	return data
+}
+
+// templateFuncs are the helper functions available in all templates
+var templateFuncs = map[string]any{
+	"date":    formatTemplateDate,
+	"default": defaultTemplateValue,
+	"join":    joinTemplateValues,
+	"now":     time.Now,
+	"address": lookupAddress,
+}
+
+// templateDateLayouts are the date formats paperless uses
+var templateDateLayouts = []string{time.RFC3339Nano, time.RFC3339, "2006-01-02T15:04:05", time.DateOnly}
+
+// formatTemplateDate formats a time or a date string of paperless with the Go layout, e.g. `{{date "02.01.2006" .Document.CreatedAt}}`.
+// Strings that can't be parsed are returned unchanged.
+func formatTemplateDate(layout string, value any) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(layout)
+	case string:
+		for _, l := range templateDateLayouts {
+			if t, err := time.Parse(l, v); err == nil {
+				return t.Format(layout)
+			}
+		}
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+// defaultTemplateValue returns def if value is empty, e.g. `{{.Correspondent.Name | default "unknown"}}`
+func defaultTemplateValue(def any, value any) any {
+	if value == nil {
+		return def
+	}
+	if v := reflect.ValueOf(value); v.IsZero() || ((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0) {
+		return def
+	}
+	return value
+}
+
+// joinTemplateValues joins a list with the separator, e.g. `{{join ", " .TagNames}}`
+func joinTemplateValues(sep string, values any) string {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Sprint(values)
+	}
+
+	parts := make([]string, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		parts = append(parts, fmt.Sprint(v.Index(i).Interface()))
+	}
+	return strings.Join(parts, sep)
+}
+
+// legacyPlaceholders maps the %placeholder% syntax of older configs to template expressions
+var legacyPlaceholders = map[string]string{
+	"user_id":              "{{with .Owner.ID}}{{.}}{{end}}",
+	"user_name":            "{{.Owner.Username}}",
+	"user_email":           "{{.Owner.Email}}",
+	"first_name":           "{{.Owner.FirstName}}",
+	"last_name":            "{{.Owner.LastName}}",
+	"correspondent_id":     "{{with .Correspondent.ID}}{{.}}{{end}}",
+	"correspondent_name":   "{{.Correspondent.Name}}",
+	"document_type_id":     "{{with .DocumentType.ID}}{{.}}{{end}}",
+	"document_type_name":   "{{.DocumentType.Name}}",
+	"storage_path_id":      "{{with .StoragePath.ID}}{{.}}{{end}}",
+	"storage_path_name":    "{{.StoragePath.Name}}",
+	"storage_path":         "{{.StoragePath.Path}}",
+	"document_id":          "{{.Document.ID}}",
+	"document_url":         "{{.Document.URL}}",
+	"document_title":       "{{.Document.Title}}",
+	"document_file_name":   "{{.Document.FileName}}",
+	"document_created_at":  "{{.Document.CreatedAt}}",
+	"document_modified_at": "{{.Document.ModifiedAt}}",
+	"sent_date":            `{{date "2006-01-02" .SentAt}}`,
+	"sent_at":              `{{date "2006-01-02T15:04:05Z07:00" .SentAt}}`,
+	"rule_name":            "{{.Rule.Name}}",
+	"receiver_addresses":   `{{join "," .Rule.ReceiverAddresses}}`,
+	"share_link":           "{{.ShareLink.URL}}",
+}
+
+// legacyPlaceholder matches %placeholder% and %custom_field:Name%
+var legacyPlaceholder = regexp.MustCompile(`%(custom_field:[^%]+|[a-zA-Z_]+)%`)
+
+// convertLegacyPlaceholders rewrites the %placeholder% syntax into template expressions.
+// Unknown placeholders are kept as they are.
+func convertLegacyPlaceholders(str string) string {
+	return legacyPlaceholder.ReplaceAllStringFunc(str, func(placeholder string) string {
+		name := strings.Trim(placeholder, "%")
+		if field, ok := strings.CutPrefix(name, "custom_field:"); ok {
+			return fmt.Sprintf("{{index .CustomFields %q}}", field)
+		}
+		if expr, ok := legacyPlaceholders[strings.ToLower(name)]; ok {
+			return expr
+		}
+		return placeholder
+	})
+}
+
+// mailTemplates holds the parsed templates of a rule
+type mailTemplates struct {
+	header *texttemplate.Template
+	body   *htmltemplate.Template
+	// plainBody is optional, without it the plain text part is converted from the html body
+	plainBody    *texttemplate.Template
+	customFields []*texttemplate.Template
+	// to and bcc are the receivers, they are rendered before the other templates
+	to  []*texttemplate.Template
+	bcc []*texttemplate.Template
+	// fromName is optional, without it the sender has no display name
+	fromName *texttemplate.Template
+	replyTo  []*texttemplate.Template
+	cc       []*texttemplate.Template
+	// headers are the values of rule.getHeaders(), same order
+	headers []*texttemplate.Template
+}
+
+// renderedMail holds the rendered templates of a mail
+type renderedMail struct {
+	Header    string
+	Body      string
+	PlainBody string
+	FromName  string
+	To        []mail.Address
+	CC        []mail.Address
+	BCC       []mail.Address
+	ReplyTo   []mail.Address
+	// Headers are the custom headers, headers that render empty are left out
+	Headers []mailHeader
+}
+
+// parsedTemplates holds the templates of every rule by rule name, they are parsed once at startup
+var parsedTemplates map[string]*mailTemplates
+
+// parseTemplates parses the header, body and custom field templates of all rules. Every template is
+// executed once with empty data, so a broken template or a misspelled field fails at startup.
+func parseTemplates() error {
+	parsed := make(map[string]*mailTemplates)
+
+	for _, r := range Config.Paperless.Rules {
+		t := &mailTemplates{}
+
+		header := r.MailHeader
+		if header == "" {
+			header = Config.Email.MailHeader
+		}
+		var err error
+		if t.header, err = parseTextTemplate(r.Name+"/MailHeader", header); err != nil {
+			return err
+		}
+
+		body, bodyName, err := r.getBodyTemplate()
+		if err != nil {
+			return err
+		}
+		if t.body, err = htmltemplate.New(bodyName).Funcs(templateFuncs).Parse(convertLegacyPlaceholders(body)); err != nil {
+			return fmt.Errorf("failed to parse template %s: %v", bodyName, err)
+		}
+
+		plainBody, plainBodyName, err := r.getPlainBodyTemplate()
+		if err != nil {
+			return err
+		}
+		if plainBody != "" {
+			if t.plainBody, err = parseTextTemplate(plainBodyName, plainBody); err != nil {
+				return err
+			}
+		}
+
+		for _, update := range r.getCustomFieldUpdates() {
+			value, err := parseTextTemplate(r.Name+"/SetCustomFields/"+update.Name, update.Value)
+			if err != nil {
+				return err
+			}
+			t.customFields = append(t.customFields, value)
+		}
+
+		if t.to, err = parseTextTemplates(r.Name+"/ReceiverAddresses", r.ReceiverAddresses); err != nil {
+			return err
+		}
+		if t.bcc, err = parseTextTemplates(r.Name+"/BCCAddresses", r.BCCAddresses); err != nil {
+			return err
+		}
+		if fromName := r.getFromName(); fromName != "" {
+			if t.fromName, err = parseTextTemplate(r.Name+"/FromName", fromName); err != nil {
+				return err
+			}
+		}
+		if t.replyTo, err = parseTextTemplates(r.Name+"/ReplyTo", r.getReplyTo()); err != nil {
+			return err
+		}
+		if t.cc, err = parseTextTemplates(r.Name+"/CCAddresses", r.getCCAddresses()); err != nil {
+			return err
+		}
+		for _, header := range r.getHeaders() {
+			value, err := parseTextTemplate(r.Name+"/Headers/"+header.Name, header.Value)
+			if err != nil {
+				return err
+			}
+			t.headers = append(t.headers, value)
+		}
+
+		for _, tmpl := range t.all() {
+			if _, err := executeTemplate(tmpl, TemplateData{}); err != nil {
+				return fmt.Errorf("failed to execute template: %v", err)
+			}
+		}
+		// fixed addresses are checked here, placeholders can only be checked when a mail is rendered
+		for _, list := range [][]*texttemplate.Template{t.to, t.cc, t.bcc, t.replyTo} {
+			if _, err := renderAddresses(list, TemplateData{}); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+
+		parsed[r.Name] = t
+	}
+
+	parsedTemplates = parsed
+	return nil
+}
+
+// all returns every template of the rule
+func (t *mailTemplates) all() []templateExecutor {
+	all := []templateExecutor{t.header, t.body}
+	if t.plainBody != nil {
+		all = append(all, t.plainBody)
+	}
+	if t.fromName != nil {
+		all = append(all, t.fromName)
+	}
+	for _, list := range [][]*texttemplate.Template{t.customFields, t.to, t.bcc, t.replyTo, t.cc, t.headers} {
+		for _, value := range list {
+			all = append(all, value)
+		}
+	}
+	return all
+}
+
+func parseTextTemplate(name, text string) (*texttemplate.Template, error) {
+	t, err := texttemplate.New(name).Funcs(templateFuncs).Parse(convertLegacyPlaceholders(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	return t, nil
+}
+
+// parseTextTemplates parses a list of templates, they are named by their index
+func parseTextTemplates(name string, texts []string) ([]*texttemplate.Template, error) {
+	var list []*texttemplate.Template
+	for idx, text := range texts {
+		t, err := parseTextTemplate(fmt.Sprintf("%s[%d]", name, idx), text)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// readTemplateFile reads a template file. Relative paths are resolved against the directory of the config file.
+func readTemplateFile(path string) (string, error) {
+	data, err := os.ReadFile(resolveConfigPath(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read template file: %v", err)
+	}
+	return string(data), nil
+}
+
+// resolveConfigPath resolves a relative path against the directory of the config file
+func resolveConfigPath(path string) string {
+	if !filepath.IsAbs(path) {
+		if configFile := viper.ConfigFileUsed(); configFile != "" {
+			path = filepath.Join(filepath.Dir(configFile), path)
+		}
+	}
+	return path
+}
+
+// templateExecutor is implemented by text/template and html/template
+type templateExecutor interface {
+	Execute(w io.Writer, data any) error
+}
+
+func executeTemplate(t templateExecutor, data TemplateData) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderMail renders the receivers, header and bodies of the rule for the document. The receivers are rendered
+// first, so the other templates get the rendered addresses in .Rule.
+func renderMail(r rule, data TemplateData) (renderedMail, error) {
+	var mail renderedMail
+
+	t, ok := parsedTemplates[r.Name]
+	if !ok {
+		return mail, fmt.Errorf("no templates for rule %s", r.Name)
+	}
+
+	var err error
+	if mail.To, err = renderAddresses(t.to, data); err != nil {
+		return mail, fmt.Errorf("failed to render receiver addresses: %v", err)
+	}
+	if len(mail.To) == 0 {
+		return mail, fmt.Errorf("no receiver address, the receiver addresses of rule %s are empty for the document", r.Name)
+	}
+	if mail.BCC, err = renderAddresses(t.bcc, data); err != nil {
+		return mail, fmt.Errorf("failed to render BCC addresses: %v", err)
+	}
+	data = data.withReceivers(mail)
+
+	if mail.Header, err = executeTemplate(t.header, data); err != nil {
+		return mail, fmt.Errorf("failed to render mail header: %v", err)
+	}
+
+	if mail.Body, err = executeTemplate(t.body, data); err != nil {
+		return mail, fmt.Errorf("failed to render mail body: %v", err)
+	}
+
+	if t.plainBody != nil {
+		if mail.PlainBody, err = executeTemplate(t.plainBody, data); err != nil {
+			return mail, fmt.Errorf("failed to render plain text mail body: %v", err)
+		}
+	}
+
+	if t.fromName != nil {
+		if mail.FromName, err = executeTemplate(t.fromName, data); err != nil {
+			return mail, fmt.Errorf("failed to render sender name: %v", err)
+		}
+		mail.FromName = strings.Join(strings.Fields(mail.FromName), " ")
+	}
+
+	if mail.ReplyTo, err = renderAddresses(t.replyTo, data); err != nil {
+		return mail, fmt.Errorf("failed to render Reply-To: %v", err)
+	}
+	if mail.CC, err = renderAddresses(t.cc, data); err != nil {
+		return mail, fmt.Errorf("failed to render CC addresses: %v", err)
+	}
+
+	for idx, header := range r.getHeaders() {
+		value, err := executeTemplate(t.headers[idx], data)
+		if err != nil {
+			return mail, fmt.Errorf("failed to render header %s: %v", header.Name, err)
+		}
+		if value = strings.TrimSpace(value); value != "" {
+			mail.Headers = append(mail.Headers, mailHeader{Name: header.Name, Value: value})
+		}
+	}
+	return mail, nil
+}
+
+// renderAddresses renders a list of address templates and parses the addresses
+func renderAddresses(templates []*texttemplate.Template, data TemplateData) ([]mail.Address, error) {
+	values := make([]string, 0, len(templates))
+	for _, t := range templates {
+		value, err := executeTemplate(t, data)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return parseRenderedAddresses(values)
+}
+
+// renderCustomFieldValues renders the values of the custom field updates of the rule, same order as rule.getCustomFieldUpdates()
+func renderCustomFieldValues(r rule, data TemplateData) ([]string, error) {
+	t, ok := parsedTemplates[r.Name]
+	if !ok {
+		return nil, fmt.Errorf("no templates for rule %s", r.Name)
+	}
+
+	values := make([]string, 0, len(t.customFields))
+	for _, value := range t.customFields {
+		text, err := executeTemplate(value, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render custom field value: %v", err)
+		}
+		values = append(values, text)
+	}
+	return values, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+)
+
+// TLSSettings configures the TLS connections to the SMTP server or to paperless. Relative paths of the
+// files are resolved against the directory of the config file, missing files fail in newTLSConfig at startup.
+type TLSSettings struct {
+	// CAFile is a PEM bundle of CAs that are trusted in addition to the system roots
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key for mutual TLS
+	CertFile   string `validate:"required_with=KeyFile"`
+	KeyFile    string `validate:"required_with=CertFile"`
+	MinVersion string `validate:"omitempty,oneof=1.0 1.1 1.2 1.3"`
+	// ServerName overrides the name the certificate of the server is verified against
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// tlsVersions maps the configured minimum versions to the constants of crypto/tls
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// the TLS configs are loaded once at startup, see loadTLSConfigs
+var (
+	// smtpTLSConfigs holds the config of every SMTP profile by name
+	smtpTLSConfigs     map[string]*tls.Config
+	paperlessTLSConfig *tls.Config
+)
+
+// newTLSConfig loads the certificates of the settings and returns the tls config. Without ServerName the
+// name of the server is set by the connection.
+func (s TLSSettings) newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tlsVersions[s.MinVersion],
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if s.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(resolveConfigPath(s.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", s.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(resolveConfigPath(s.CertFile), resolveConfigPath(s.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// verifiesServer returns true if the settings name the CA or the server name to verify the certificate against,
+// opportunistic STARTTLS only verifies the certificate then
+func (s TLSSettings) verifiesServer() bool {
+	return s.CAFile != "" || s.ServerName != ""
+}
+
+// forServer returns a copy of the config for a connection to host, a configured ServerName takes precedence
+func forServer(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		return &tls.Config{ServerName: host}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+// loadTLSConfigs loads the TLS settings of the SMTP profiles and of paperless, so broken certificates fail at startup
+func loadTLSConfigs() error {
+	smtpTLSConfigs = make(map[string]*tls.Config)
+	for _, name := range Config.Email.getSMTPProfileNames() {
+		account, _ := Config.Email.getSMTPProfile(name)
+		config, err := account.TLS.newTLSConfig()
+		if err != nil {
+			return fmt.Errorf("TLS of SMTP profile %s: %v", name, err)
+		}
+		smtpTLSConfigs[name] = config
+
+		if account.TLS.InsecureSkipVerify {
+			log.Printf("WARNING: certificate verification of the SMTP server of profile %s is disabled by TLS.InsecureSkipVerify, the connection and the credentials can be intercepted", name)
+		} else if account.SMTPConnectionType == connectionPlain && !account.TLS.verifiesServer() {
+			warning := fmt.Sprintf("WARNING: opportunistic STARTTLS of SMTP profile %s does not verify the certificate of the server, set TLS.CAFile or TLS.ServerName to verify it", name)
+			if account.hasCredentials() {
+				warning += ", the credentials are sent over a connection that can be intercepted"
+			}
+			log.Print(warning)
+		}
+	}
+
+	var err error
+	if paperlessTLSConfig, err = Config.Paperless.TLS.newTLSConfig(); err != nil {
+		return fmt.Errorf("Paperless.TLS: %v", err)
+	}
+	if Config.Paperless.TLS.InsecureSkipVerify {
+		log.Printf("WARNING: certificate verification of paperless is disabled by Paperless.TLS.InsecureSkipVerify, the connection and the api token can be intercepted")
+	}
+	return nil
+}